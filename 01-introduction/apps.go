@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// App bundles the map and reduce functions that make up a MapReduce application
+// An app needs one of the map functions and one of the reduce functions.
+// Apps without a plain Map cannot be sorted, since the sort mode samples
+// keys by calling Map directly.
+type App struct {
+	Map           MapFunction
+	RecordMap     RecordMapFunction  // optional, used instead of Map if set
+	MapContext    ContextMapFunction // optional, used instead of Map and RecordMap if set
+	MapChunk      ChunkMapFunction   // optional, used instead of Map, RecordMap and MapContext if set
+	Reduce        ReduceFunction
+	StreamReduce  StreamReduceFunction  // optional, used instead of Reduce if set
+	ReduceContext ContextReduceFunction // optional, used instead of Reduce and StreamReduce if set
+
+	ReducePartition PartitionReduceFunction // optional, used instead of the other reduce functions if set
+	Combine         CombineFunction         // optional
+	Partitioner     Partitioner             // optional, used when the job does not set one
+	Input           InputFormat             // optional, used when the job does not set one
+}
+
+// apps lists the applications that can be selected by name from the command line
+var apps = map[string]App{
+	"wc":       {Map: WordCountMap, Reduce: WordCountReduce, StreamReduce: WordCountStreamReduce, Combine: WordCountReduce},
+	"wc-typed": WordCountJob.App(),
+	"crash":    {Map: CrashMap, Reduce: CrashReduce, Combine: WordCountReduce},
+	"straggle": {Map: StraggleMap, Reduce: WordCountReduce, Combine: WordCountReduce},
+	"vanish":   {Map: WordCountMap, Reduce: VanishReduce, Combine: WordCountReduce},
+	"sort":     {Map: SortMap, Reduce: SortReduce},
+
+	"index":    {Map: IndexMap, Reduce: IndexReduce},
+	"grep":     GrepApp(regexp.MustCompile("")),
+	"ngram":    NGramApp(2),
+	"tfidf":    TFIDFApp(0),
+	"join":     JoinApp(),
+	"distinct": DistinctApp(),
+	"pagerank": PageRankApp(DefaultDamping),
+}
+
+// configureApps rebuilds the apps that take settings from the command line
+// numDocs is the number of input files, needed by tfidf; 0 means unknown.
+func configureApps(pattern string, n, numDocs int) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("grep pattern: %w", err)
+	}
+	if n < 1 {
+		return fmt.Errorf("n-gram length must be at least 1, not %d", n)
+	}
+	apps["grep"] = GrepApp(re)
+	apps["ngram"] = NGramApp(n)
+	apps["tfidf"] = TFIDFApp(numDocs)
+	return nil
+}
+
+// lookupApp returns the application registered under name, or loads it
+// from a plugin if name is the path of a .so file
+func lookupApp(name string) (App, error) {
+	if strings.HasSuffix(name, ".so") {
+		return loadPlugin(name)
+	}
+	app, ok := apps[name]
+	if !ok {
+		return App{}, fmt.Errorf("unknown app %q (available: %v, or a plugin .so file)", name, appNames())
+	}
+	return app, nil
+}
+
+// checkApp makes sure an app has a map and a reduce function to run
+func checkApp(app App) error {
+	if app.Map == nil && app.RecordMap == nil && app.MapContext == nil && app.MapChunk == nil {
+		return errors.New("the app has no map function")
+	}
+	if app.Reduce == nil && app.StreamReduce == nil && app.ReduceContext == nil && app.ReducePartition == nil {
+		return errors.New("the app has no reduce function")
+	}
+	return nil
+}
+
+// appNames returns the registered application names in sorted order
+func appNames() []string {
+	var names []string
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
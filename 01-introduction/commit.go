@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix starts the name of every file still being written by a task
+const tempPrefix = "mr-tmp-"
+
+// jobTempPrefix starts the names of one job's temporary files, so that a
+// job cleaning up after itself leaves other jobs' files alone
+func jobTempPrefix(jobID string) string {
+	return tempPrefix + jobID + "-"
+}
+
+// atomicFile is an output file written under a temporary name and renamed
+// into place once it is complete. A task that crashes part way through
+// leaves only a temporary file behind, and two attempts at the same task
+// each publish a complete file, so later stages never read partial output.
+type atomicFile struct {
+	*os.File
+	name string // final name
+}
+
+// createAtomic starts writing the file that job jobID will publish as name
+func createAtomic(name, jobID string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(name), jobTempPrefix(jobID)+filepath.Base(name)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: file, name: name}, nil
+}
+
+// Commit closes the file and renames it to its final name
+func (f *atomicFile) Commit() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("writing %s: %w", f.name, err)
+	}
+	if err := os.Rename(f.File.Name(), f.name); err != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("committing %s: %w", f.name, err)
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file without publishing it
+func (f *atomicFile) Abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// removeTempFiles deletes the temporary files that tasks of job jobID
+// left in dir when they died
+func removeTempFiles(dir, jobID string) {
+	removeWithPrefix(dir, jobTempPrefix(jobID))
+}
+
+// removeTempFilesFor deletes the temporary files that tasks of job jobID
+// which died left while writing name, and no others
+func removeTempFilesFor(name, jobID string) {
+	removeWithPrefix(filepath.Dir(name), jobTempPrefix(jobID)+filepath.Base(name)+"-")
+}
+
+// removeWithPrefix deletes the files in dir whose names start with prefix
+func removeWithPrefix(dir, prefix string) {
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// errCommitDenied reports that another copy of a task published its
+// output first, so this copy's output was discarded
+var errCommitDenied = errors.New("another copy of the task already finished; output discarded")
+
+// commitCheckKey finds a task's commit check among a context's values
+type commitCheckKey struct{}
+
+// withCommitCheck returns a context under which tasks call check just
+// before publishing their output, and abort if it fails. Workers use it
+// to let the coordinator pick one copy of a task whose output counts.
+func withCommitCheck(ctx context.Context, check func() error) context.Context {
+	return context.WithValue(ctx, commitCheckKey{}, check)
+}
+
+// mayCommit runs the commit check of ctx, if it has one
+func mayCommit(ctx context.Context) error {
+	if check, ok := ctx.Value(commitCheckKey{}).(func() error); ok {
+		return check()
+	}
+	return nil
+}
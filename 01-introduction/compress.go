@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Compression selects how intermediate files are compressed
+type Compression string
+
+const (
+	CompressNone Compression = "none"
+	// CompressGzip gives the smallest files but costs the most CPU
+	CompressGzip Compression = "gzip"
+	// CompressLZ is a fast LZ4-style codec: larger files than gzip but
+	// much cheaper to write and read
+	CompressLZ Compression = "lz"
+)
+
+// Compressed files start with compressMagic followed by one byte naming
+// the codec, so readers detect compression without being told. Neither
+// JSON nor binary intermediate files can start with these bytes.
+const compressMagic = "MRZ\x01"
+
+var codecIDs = map[Compression]byte{
+	CompressGzip: 1,
+	CompressLZ:   2,
+}
+
+// parseCompression checks a compression name from the command line
+func parseCompression(name string) (Compression, error) {
+	c := Compression(name)
+	if _, ok := codecIDs[c]; ok || c == CompressNone {
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q (available: none, gzip, lz)", name)
+}
+
+// nopWriteCloser lets an uncompressed writer be closed like a compressor
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressWriter wraps w so that everything written is compressed with c
+// Close flushes the compressor but does not close w
+func newCompressWriter(c Compression, w io.Writer) (io.WriteCloser, error) {
+	if c == CompressNone || c == "" {
+		return nopWriteCloser{w}, nil
+	}
+	id, ok := codecIDs[c]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+	if _, err := w.Write(append([]byte(compressMagic), id)); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return newLZWriter(w), nil
+	}
+}
+
+// newDecompressReader looks at the start of r and, if it carries a
+// compression header, returns a reader that decompresses the rest
+// Uncompressed data is returned unchanged
+func newDecompressReader(r *bufio.Reader) (io.Reader, error) {
+	header, err := r.Peek(len(compressMagic) + 1)
+	if err != nil || string(header[:len(compressMagic)]) != compressMagic {
+		return r, nil // too short or no header: not compressed
+	}
+	r.Discard(len(header))
+
+	switch id := header[len(compressMagic)]; id {
+	case codecIDs[CompressGzip]:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return corruptOnError{zr}, nil
+	case codecIDs[CompressLZ]:
+		return newLZReader(r), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown compression codec %d", ErrCorrupt, id)
+	}
+}
+
+// corruptOnError marks decompression failures as corruption
+type corruptOnError struct {
+	r io.Reader
+}
+
+func (c corruptOnError) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF && !errors.Is(err, ErrCorrupt) {
+		err = fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return n, err
+}
+
+// The lz codec splits the stream into blocks of up to lzBlockSize bytes.
+// Each block is written as
+//
+//	uvarint length of the uncompressed block
+//	uvarint length of the compressed block, or 0 if it is stored as is
+//	the block data
+//
+// An end marker closes the stream: a uvarint 0 where the next block's
+// length would be, the uvarint total uncompressed length and the CRC-32C
+// of all uncompressed bytes. A stream cut off between two blocks, or with
+// a damaged literal, is then reported as corrupt instead of ending early.
+//
+// Compressed blocks use the LZ4 block format: a sequence of tokens, each
+// giving a run of literal bytes followed by a match to copy from up to
+// 64KB earlier in the block.
+const (
+	lzBlockSize   = 64 << 10
+	lzMinMatch    = 4
+	lzHashBits    = 14
+	lzLastLiteral = 5  // the final bytes of a block are always literals
+	lzMatchLimit  = 12 // no match may start this close to the end
+)
+
+// lzWriter compresses a stream block by block
+type lzWriter struct {
+	w     io.Writer
+	buf   []byte
+	out   []byte
+	table [1 << lzHashBits]int32
+	total uint64
+	sum   uint32
+}
+
+func newLZWriter(w io.Writer) *lzWriter {
+	return &lzWriter{w: w, buf: make([]byte, 0, lzBlockSize)}
+}
+
+func (lw *lzWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(lw.buf[len(lw.buf):cap(lw.buf)], p)
+		lw.buf = lw.buf[:len(lw.buf)+n]
+		p = p[n:]
+		written += n
+		if len(lw.buf) == cap(lw.buf) {
+			if err := lw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close flushes the last block and writes the end marker
+func (lw *lzWriter) Close() error {
+	if err := lw.flush(); err != nil {
+		return err
+	}
+	marker := binary.AppendUvarint([]byte{0}, lw.total)
+	marker = binary.BigEndian.AppendUint32(marker, lw.sum)
+	_, err := lw.w.Write(marker)
+	return err
+}
+
+// flush compresses and writes the buffered block
+func (lw *lzWriter) flush() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	lw.total += uint64(len(lw.buf))
+	lw.sum = crc32.Update(lw.sum, crcTable, lw.buf)
+	lw.out = lzCompress(lw.out[:0], lw.buf, &lw.table)
+
+	header := binary.AppendUvarint(nil, uint64(len(lw.buf)))
+	data := lw.out
+	if len(lw.out) >= len(lw.buf) {
+		// Incompressible: store the block as is
+		header = binary.AppendUvarint(header, 0)
+		data = lw.buf
+	} else {
+		header = binary.AppendUvarint(header, uint64(len(lw.out)))
+	}
+	if _, err := lw.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := lw.w.Write(data); err != nil {
+		return err
+	}
+	lw.buf = lw.buf[:0]
+	return nil
+}
+
+func lzHash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lzHashBits)
+}
+
+// appendLength appends the extra bytes of a token length that did not fit in its nibble
+func appendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lzCompress appends the LZ4 block encoding of src to dst
+func lzCompress(dst, src []byte, table *[1 << lzHashBits]int32) []byte {
+	for i := range table {
+		table[i] = -1
+	}
+
+	anchor := 0
+	for i := 0; i+lzMatchLimit <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(seq)
+		candidate := int(table[h])
+		table[h] = int32(i)
+		if candidate < 0 || i-candidate > 0xFFFF || binary.LittleEndian.Uint32(src[candidate:]) != seq {
+			i++
+			continue
+		}
+
+		// Extend the match as far as the block allows
+		length := lzMinMatch
+		for i+length < len(src)-lzLastLiteral && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		literals := i - anchor
+		token := len(dst)
+		dst = append(dst, 0)
+		if literals >= 15 {
+			dst[token] = 15 << 4
+			dst = appendLength(dst, literals-15)
+		} else {
+			dst[token] = byte(literals << 4)
+		}
+		dst = append(dst, src[anchor:i]...)
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(i-candidate))
+		if ml := length - lzMinMatch; ml >= 15 {
+			dst[token] |= 15
+			dst = appendLength(dst, ml-15)
+		} else {
+			dst[token] |= byte(ml)
+		}
+
+		i += length
+		anchor = i
+	}
+
+	// The last sequence holds only literals
+	literals := len(src) - anchor
+	if literals >= 15 {
+		dst = append(dst, 15<<4)
+		dst = appendLength(dst, literals-15)
+	} else {
+		dst = append(dst, byte(literals<<4))
+	}
+	return append(dst, src[anchor:]...)
+}
+
+var errLZCorrupt = fmt.Errorf("%w: bad lz block", ErrCorrupt)
+
+// readLength reads the extra bytes of a token length
+func readLength(src []byte, pos *int, n int) (int, error) {
+	for {
+		if *pos >= len(src) {
+			return 0, errLZCorrupt
+		}
+		b := src[*pos]
+		*pos++
+		n += int(b)
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
+
+// lzDecompress decodes an LZ4 block into dst, which must be exactly the
+// uncompressed size
+func lzDecompress(dst, src []byte) error {
+	pos, out := 0, 0
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			var err error
+			if literals, err = readLength(src, &pos, literals); err != nil {
+				return err
+			}
+		}
+		if pos+literals > len(src) || out+literals > len(dst) {
+			return errLZCorrupt
+		}
+		out += copy(dst[out:], src[pos:pos+literals])
+		pos += literals
+		if pos == len(src) {
+			break // last sequence
+		}
+
+		if pos+2 > len(src) {
+			return errLZCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[pos:]))
+		pos += 2
+		length := int(token & 15)
+		if length == 15 {
+			var err error
+			if length, err = readLength(src, &pos, length); err != nil {
+				return err
+			}
+		}
+		length += lzMinMatch
+		if offset == 0 || offset > out || out+length > len(dst) {
+			return errLZCorrupt
+		}
+		// Byte by byte, since the match may overlap what it produces
+		for j := 0; j < length; j++ {
+			dst[out+j] = dst[out-offset+j]
+		}
+		out += length
+	}
+	if out != len(dst) {
+		return errLZCorrupt
+	}
+	return nil
+}
+
+// lzReader decompresses a stream written by lzWriter
+type lzReader struct {
+	r     *bufio.Reader
+	block []byte
+	comp  []byte
+	pos   int
+	total uint64
+	sum   uint32
+	done  bool
+}
+
+func newLZReader(r *bufio.Reader) *lzReader {
+	return &lzReader{r: r}
+}
+
+// nextBlock reads and decompresses the next block
+func (lr *lzReader) nextBlock() error {
+	if lr.done {
+		return io.EOF
+	}
+	rawLen, err := binary.ReadUvarint(lr.r)
+	if err == io.EOF {
+		return fmt.Errorf("%w: lz stream ends without an end marker", ErrCorrupt)
+	}
+	if err != nil {
+		return errLZCorrupt
+	}
+	if rawLen == 0 {
+		return lr.endMarker()
+	}
+	compLen, err := binary.ReadUvarint(lr.r)
+	if err != nil || rawLen > lzBlockSize || compLen > lzBlockSize {
+		return errLZCorrupt
+	}
+
+	if cap(lr.block) < int(rawLen) {
+		lr.block = make([]byte, rawLen)
+	}
+	lr.block = lr.block[:rawLen]
+	lr.pos = 0
+	if compLen == 0 {
+		if _, err := io.ReadFull(lr.r, lr.block); err != nil {
+			return errLZCorrupt
+		}
+	} else {
+		if cap(lr.comp) < int(compLen) {
+			lr.comp = make([]byte, compLen)
+		}
+		lr.comp = lr.comp[:compLen]
+		if _, err := io.ReadFull(lr.r, lr.comp); err != nil {
+			return errLZCorrupt
+		}
+		if err := lzDecompress(lr.block, lr.comp); err != nil {
+			return err
+		}
+	}
+	lr.total += rawLen
+	lr.sum = crc32.Update(lr.sum, crcTable, lr.block)
+	return nil
+}
+
+// endMarker checks the length and checksum that close the stream against
+// what was read, and that nothing follows them
+func (lr *lzReader) endMarker() error {
+	total, err := binary.ReadUvarint(lr.r)
+	if err != nil {
+		return fmt.Errorf("%w: truncated lz end marker", ErrCorrupt)
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(lr.r, sum[:]); err != nil {
+		return fmt.Errorf("%w: truncated lz end marker", ErrCorrupt)
+	}
+	if total != lr.total {
+		return fmt.Errorf("%w: lz stream should hold %d bytes, read %d", ErrCorrupt, total, lr.total)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != lr.sum {
+		return fmt.Errorf("%w: checksum mismatch in lz stream", ErrCorrupt)
+	}
+	if _, err := lr.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("%w: data after lz end marker", ErrCorrupt)
+	}
+	lr.done = true
+	return io.EOF
+}
+
+func (lr *lzReader) Read(p []byte) (int, error) {
+	for lr.pos >= len(lr.block) {
+		if err := lr.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, lr.block[lr.pos:])
+	lr.pos += n
+	return n, nil
+}
+
+// compressedRecordWriter flushes its records and then the compressor beneath them
+type compressedRecordWriter struct {
+	recordWriter
+	z io.WriteCloser
+}
+
+func (w compressedRecordWriter) Close() error {
+	if err := w.recordWriter.Close(); err != nil {
+		return err
+	}
+	return w.z.Close()
+}
+
+// newIntermediateWriter returns a writer producing an intermediate file
+// with the given record encoding and compression
+func newIntermediateWriter(w io.Writer, e Encoding, c Compression) (recordWriter, error) {
+	z, err := newCompressWriter(c, w)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := newRecordWriter(e, z)
+	if err != nil {
+		return nil, err
+	}
+	return compressedRecordWriter{recordWriter: rw, z: z}, nil
+}
+
+// newIntermediateReader returns a reader for an intermediate file with the
+// given record encoding, detecting any compression from the file header
+func newIntermediateReader(r *bufio.Reader, e Encoding) (recordReader, error) {
+	dr, err := newDecompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newRecordReader(e, dr)
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// taskState tracks where a task is in its lifecycle
+type taskState int
+
+const (
+	taskIdle taskState = iota
+	taskInProgress
+	taskCompleted
+)
+
+// attempt is one copy of a task running on a worker
+type attempt struct {
+	worker    string
+	startTime time.Time
+}
+
+// taskInfo is the coordinator's bookkeeping for a single task
+type taskInfo struct {
+	task     Task
+	state    taskState
+	running  map[int]attempt // copies still running, by attempt number
+	backup   int             // attempt number of the backup copy; 0 if none was launched
+	commit   int             // attempt number allowed to publish its output; 0 if none yet
+	counters Counters        // counters of the attempt that completed the task
+	addr     string          // shuffle address of the worker holding a completed map task's output
+	worker   string          // worker whose copy completed the task
+	duration time.Duration   // run time of the copy that completed the task
+}
+
+// DefaultTaskTimeout is how long a worker may hold a task before the
+// coordinator assumes it has died and hands the task to someone else
+const DefaultTaskTimeout = 10 * time.Second
+
+// DefaultSpeculation is how many times the median task duration of its
+// phase a task may run before the coordinator launches a backup copy
+const DefaultSpeculation = 2.0
+
+// minBackupRuntime is how long a task must run before it can get a backup,
+// so that phases of very short tasks do not launch backups for nothing
+const minBackupRuntime = time.Second
+
+// Coordinator hands out map and reduce tasks to workers over RPC
+// Reduce tasks are only handed out once every map task has completed.
+// Near the end of a phase, a task running well past the median duration of
+// the phase's completed tasks gets a backup copy on another worker; the
+// first copy to finish completes the task and the other's report is ignored.
+// When workers serve map output over HTTP, a reduce task that cannot fetch
+// from a worker sends every map task whose output it held back to be run
+// again.
+type Coordinator struct {
+	mu          sync.Mutex
+	job         *MapReduce    // describes the tasks; its functions are unused
+	timeout     time.Duration // how long before an in-progress task is re-executed
+	speculation float64       // multiple of the median duration that triggers a backup; 0 disables backups
+	mapTasks    []taskInfo
+	reduceTasks []taskInfo
+	mapsLeft    int
+	reducesLeft int
+	durations   map[TaskType][]time.Duration // run times of the completed tasks of each phase
+	counters    Counters                     // totals over all completed tasks
+	started     time.Time
+	finished    time.Time // when the last task completed; zero until then
+}
+
+// NewCoordinator creates a coordinator that hands out the tasks of job
+// The job's map and reduce functions are not used: workers bring their own.
+// Tasks not reported done within timeout are handed to another worker
+func NewCoordinator(job *MapReduce, timeout time.Duration) (*Coordinator, error) {
+	if err := checkNReduce(job.nReduce); err != nil {
+		return nil, err
+	}
+	splits, err := job.Splits()
+	if err != nil {
+		return nil, err
+	}
+	nMap := len(splits)
+	c := &Coordinator{
+		job:         job,
+		timeout:     timeout,
+		speculation: DefaultSpeculation,
+		mapTasks:    make([]taskInfo, nMap),
+		reduceTasks: make([]taskInfo, job.nReduce),
+		mapsLeft:    nMap,
+		reducesLeft: job.nReduce,
+		durations:   make(map[TaskType][]time.Duration),
+		counters:    make(Counters),
+		started:     time.Now(),
+	}
+	for i := range c.mapTasks {
+		c.mapTasks[i].task = job.mapTask(i)
+	}
+	for r := range c.reduceTasks {
+		c.reduceTasks[r].task = job.reduceTask(r)
+	}
+	// A partitioner or input format of a type not registered with gob,
+	// such as a PartitionerFunc, would fail every RequestTask call
+	if nMap > 0 {
+		if err := gob.NewEncoder(io.Discard).Encode(c.mapTasks[0].task); err != nil {
+			return nil, fmt.Errorf("map tasks cannot be sent to workers: %w", err)
+		}
+	}
+	// Always list the backup counters in the job summary
+	c.counters[BackupTasksLaunched], c.counters[BackupTasksWon] = 0, 0
+	if err := job.openLog(); err != nil {
+		return nil, err
+	}
+	job.logf("job %s started: %d map tasks, %d reduce tasks, inputs %v", job.id, nMap, job.nReduce, job.inputFiles)
+	return c, nil
+}
+
+// SetSpeculation sets how many times the median task duration a task may
+// run before it gets a backup copy. 0 disables backup tasks
+func (c *Coordinator) SetSpeculation(factor float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.speculation = factor
+}
+
+// Serve registers the coordinator's RPC handlers and starts accepting
+// workers on addr in the background
+func (c *Coordinator) Serve(addr string) error {
+	server := rpc.NewServer()
+	if err := server.Register(c); err != nil {
+		return err
+	}
+	l, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	go server.Accept(l)
+	return nil
+}
+
+// assign picks the first idle task in tasks and starts a copy of it on worker
+// Copies whose worker has not reported back within the timeout are
+// forgotten, making the coordinator ignore a late report from them; a task
+// left with no running copy is idle again. If no task is idle, assign
+// tries to start a backup copy of a straggler instead.
+func (c *Coordinator) assign(tasks []taskInfo, worker string) (Task, bool) {
+	for i := range tasks {
+		info := &tasks[i]
+		if info.state != taskInProgress {
+			continue
+		}
+		for n, a := range info.running {
+			if time.Since(a.startTime) > c.timeout {
+				log.Printf("%v task %d timed out on %s, re-executing", info.task.Type, info.task.ID, a.worker)
+				c.forget(info, n)
+			}
+		}
+		if len(info.running) == 0 {
+			info.state = taskIdle
+		}
+	}
+	for i := range tasks {
+		if info := &tasks[i]; info.state == taskIdle {
+			info.state = taskInProgress
+			return c.start(info, worker), true
+		}
+	}
+	if info := c.straggler(tasks, worker); info != nil {
+		task := c.start(info, worker)
+		info.backup = task.Attempt
+		c.counters[BackupTasksLaunched]++
+		log.Printf("%v task %d is straggling, launching a backup on %s", info.task.Type, info.task.ID, worker)
+		c.job.logf("%v task %d is straggling, launching a backup on %s", info.task.Type, info.task.ID, worker)
+		return task, true
+	}
+	return Task{}, false
+}
+
+// forget drops a copy of a task that failed or timed out, allowing
+// another copy to publish its output instead
+func (c *Coordinator) forget(info *taskInfo, n int) {
+	delete(info.running, n)
+	if info.commit == n {
+		info.commit = 0
+	}
+}
+
+// start hands a new attempt of the task to worker
+func (c *Coordinator) start(info *taskInfo, worker string) Task {
+	info.task.Attempt++
+	if info.running == nil {
+		info.running = make(map[int]attempt)
+	}
+	info.running[info.task.Attempt] = attempt{worker: worker, startTime: time.Now()}
+	return info.task
+}
+
+// straggler returns a task of the phase that deserves a backup copy on
+// worker, or nil. Backups are only launched once half of the phase's tasks
+// have completed, for tasks running more than c.speculation times the
+// median duration, and at most once per task.
+func (c *Coordinator) straggler(tasks []taskInfo, worker string) *taskInfo {
+	if c.speculation <= 0 || len(tasks) == 0 {
+		return nil
+	}
+	durations := c.durations[tasks[0].task.Type]
+	if 2*len(durations) < len(tasks) {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	limit := time.Duration(c.speculation * float64(sorted[len(sorted)/2]))
+	if limit < minBackupRuntime {
+		limit = minBackupRuntime
+	}
+
+	for i := range tasks {
+		info := &tasks[i]
+		if info.state != taskInProgress || info.backup != 0 || len(info.running) != 1 {
+			continue
+		}
+		for _, a := range info.running {
+			if a.worker != worker && time.Since(a.startTime) > limit {
+				return info
+			}
+		}
+	}
+	return nil
+}
+
+// RequestTask is called by workers to get their next task
+func (c *Coordinator) RequestTask(args *RequestTaskArgs, reply *RequestTaskReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.mapsLeft > 0:
+		if task, ok := c.assign(c.mapTasks, args.WorkerID); ok {
+			reply.Task = task
+			return nil
+		}
+	case c.reducesLeft > 0:
+		if task, ok := c.assign(c.reduceTasks, args.WorkerID); ok {
+			task.MapAddrs = c.mapAddrs()
+			reply.Task = task
+			return nil
+		}
+	default:
+		reply.Task = Task{Type: ExitTask}
+		return nil
+	}
+
+	// Every task of the current phase is running somewhere
+	reply.Task = Task{Type: WaitTask}
+	return nil
+}
+
+// CommitTask is called by workers that have written a task's output, to
+// ask whether they may publish it. The first running copy to ask is
+// allowed to; the others must discard their output.
+func (c *Coordinator) CommitTask(args *CommitTaskArgs, reply *CommitTaskReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var tasks []taskInfo
+	switch args.Type {
+	case MapTask:
+		tasks = c.mapTasks
+	case ReduceTask:
+		tasks = c.reduceTasks
+	default:
+		return fmt.Errorf("unexpected commit for %v task", args.Type)
+	}
+	if args.ID < 0 || args.ID >= len(tasks) {
+		return fmt.Errorf("unknown %v task %d", args.Type, args.ID)
+	}
+	info := &tasks[args.ID]
+	_, running := info.running[args.Attempt]
+	if info.state == taskInProgress && running && (info.commit == 0 || info.commit == args.Attempt) {
+		info.commit = args.Attempt
+		reply.OK = true
+	}
+	return nil
+}
+
+// ReportTask is called by workers when a task finishes or fails
+func (c *Coordinator) ReportTask(args *ReportTaskArgs, reply *ReportTaskReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var tasks []taskInfo
+	var left *int
+	switch args.Type {
+	case MapTask:
+		tasks, left = c.mapTasks, &c.mapsLeft
+	case ReduceTask:
+		tasks, left = c.reduceTasks, &c.reducesLeft
+	default:
+		return fmt.Errorf("unexpected report for %v task", args.Type)
+	}
+	if args.ID < 0 || args.ID >= len(tasks) {
+		return fmt.Errorf("unknown %v task %d", args.Type, args.ID)
+	}
+
+	info := &tasks[args.ID]
+	a, running := info.running[args.Attempt]
+	if info.state != taskInProgress || !running {
+		// Either another copy of the task already completed or this copy
+		// was re-executed after its worker timed out; the report is stale
+		// and must not count
+		fmt.Printf("Ignoring stale report for %v task %d from %s\n", args.Type, args.ID, args.WorkerID)
+		return nil
+	}
+	if args.Err != "" {
+		log.Printf("%v task %d failed on %s: %s", args.Type, args.ID, args.WorkerID, args.Err)
+		c.job.logf("%v task %d failed on %s: %s", args.Type, args.ID, args.WorkerID, args.Err)
+		c.forget(info, args.Attempt)
+		if len(info.running) == 0 {
+			info.state = taskIdle
+		}
+		if args.LostAddr != "" {
+			c.rerunMaps(args.LostAddr)
+		}
+		return nil
+	}
+
+	// The first copy to finish wins; reports from the others will be ignored
+	info.state = taskCompleted
+	info.running = nil
+	info.counters = args.Counters
+	info.addr = args.ShuffleAddr
+	info.worker = args.WorkerID
+	info.duration = time.Since(a.startTime)
+	if info.backup != 0 && info.backup == args.Attempt {
+		c.counters[BackupTasksWon]++
+	}
+	*left--
+	if c.mapsLeft == 0 && c.reducesLeft == 0 {
+		c.finished = time.Now()
+	}
+	c.durations[args.Type] = append(c.durations[args.Type], info.duration)
+	c.counters.Add(args.Counters)
+	fmt.Printf("%v task %d completed by %s\n", args.Type, args.ID, args.WorkerID)
+	c.job.logf("%v task %d completed by %s in %v", args.Type, args.ID, args.WorkerID, info.duration.Round(time.Microsecond))
+	return nil
+}
+
+// mapAddrs returns the shuffle address of each map task's output, or nil
+// if every map task's output is on the shared filesystem
+func (c *Coordinator) mapAddrs() []string {
+	addrs := make([]string, len(c.mapTasks))
+	remote := false
+	for m, info := range c.mapTasks {
+		addrs[m] = info.addr
+		remote = remote || info.addr != ""
+	}
+	if !remote {
+		return nil
+	}
+	return addrs
+}
+
+// rerunMaps makes every map task whose output is served from addr run
+// again, because a reduce task could not fetch from there and the worker
+// has most likely died. Once re-run, the output is served from another
+// address, so several reduce tasks reporting the same loss re-run each
+// task only once.
+func (c *Coordinator) rerunMaps(addr string) {
+	for m := range c.mapTasks {
+		info := &c.mapTasks[m]
+		if info.state != taskCompleted || info.addr != addr {
+			continue
+		}
+		log.Printf("output of map task %d on %s is lost, re-running it", m, addr)
+		c.job.logf("output of map task %d on %s is lost, re-running it", m, addr)
+		info.state = taskIdle
+		info.addr, info.worker, info.duration = "", "", 0
+		info.backup, info.commit = 0, 0
+		c.counters.Sub(info.counters)
+		info.counters = nil
+		c.mapsLeft++
+	}
+}
+
+// Done reports whether every reduce task has completed
+func (c *Coordinator) Done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mapsLeft == 0 && c.reducesLeft == 0
+}
+
+// Counters returns a copy of the counters of every completed task
+func (c *Coordinator) Counters() Counters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counters := make(Counters)
+	counters.Add(c.counters)
+	return counters
+}
+
+// PrintTaskCounters writes the user counters of each completed task to w
+func (c *Coordinator) PrintTaskCounters(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	perTask := make(map[taskKey]Counters)
+	for _, tasks := range [][]taskInfo{c.mapTasks, c.reduceTasks} {
+		for _, info := range tasks {
+			if info.state == taskCompleted {
+				perTask[taskKey{info.task.Type, info.task.ID}] = info.counters
+			}
+		}
+	}
+	printTaskCounters(w, perTask)
+}
+
+// Wait blocks until the job is done and then removes the intermediate files
+func (c *Coordinator) Wait() {
+	for !c.Done() {
+		time.Sleep(500 * time.Millisecond)
+	}
+	c.job.Cleanup()
+	c.job.logf("job complete")
+	c.job.closeLog()
+}
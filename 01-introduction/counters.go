@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Names of the built-in counters maintained by the framework
+const (
+	MapInputBytes        = "map_input_bytes"
+	MapInputRecords      = "map_input_records"
+	MapOutputRecords     = "map_output_records"
+	CombineInputRecords  = "combine_input_records"
+	CombineOutputRecords = "combine_output_records"
+	IntermediateBytes    = "intermediate_bytes"
+	ReduceInputRecords   = "reduce_input_records"
+	ReduceOutputRecords  = "reduce_output_records"
+	ShuffleFetchedBytes  = "shuffle_fetched_bytes"
+
+	BackupTasksLaunched = "backup_tasks_launched"
+	BackupTasksWon      = "backup_tasks_won"
+)
+
+// userCounterPrefix is prepended to the names of counters reported by map
+// and reduce functions, so they cannot clash with the built-in counters
+// and are listed after them
+const userCounterPrefix = "user."
+
+// Counters holds named event counts reported by tasks
+type Counters map[string]int64
+
+// Add adds every count in other to c
+func (c Counters) Add(other Counters) {
+	for name, n := range other {
+		c[name] += n
+	}
+}
+
+// Sub subtracts every count in other from c
+func (c Counters) Sub(other Counters) {
+	for name, n := range other {
+		c[name] -= n
+	}
+}
+
+// Print writes the counters to w, one per line in name order
+func (c Counters) Print(w io.Writer) {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-24s %d\n", name, c[name])
+	}
+}
+
+// taskKey identifies a task in a table of per-task counters
+type taskKey struct {
+	Type TaskType
+	ID   int
+}
+
+// printTaskCounters writes the user counters of each task to w, one task
+// per line in task order, under a heading. Tasks without user counters
+// are left out, and nothing is written if no task has any.
+func printTaskCounters(w io.Writer, perTask map[taskKey]Counters) {
+	keys := make([]taskKey, 0, len(perTask))
+	for key := range perTask {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	heading := false
+	for _, key := range keys {
+		var names []string
+		for name := range perTask[key] {
+			if strings.HasPrefix(name, userCounterPrefix) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		if !heading {
+			fmt.Fprintln(w, "Counters by task:")
+			heading = true
+		}
+		counts := make([]string, len(names))
+		for i, name := range names {
+			counts[i] = fmt.Sprintf("%s=%d", strings.TrimPrefix(name, userCounterPrefix), perTask[key][name])
+		}
+		fmt.Fprintf(w, "  %v task %d: %s\n", key.Type, key.ID, strings.Join(counts, " "))
+	}
+}
+
+// TaskContext is handed to map and reduce functions that report counters
+// It is also the context.Context of the task, so it is cancelled when the
+// job is.
+type TaskContext struct {
+	context.Context
+	Type TaskType
+	ID   int
+
+	mu       sync.Mutex
+	counters Counters
+}
+
+// taskContextKey finds the TaskContext among a context's values
+type taskContextKey struct{}
+
+func newTaskContext(ctx context.Context, task Task) *TaskContext {
+	return &TaskContext{Context: ctx, Type: task.Type, ID: task.ID, counters: make(Counters)}
+}
+
+// Value makes the TaskContext reachable from contexts derived from it
+func (tc *TaskContext) Value(key any) any {
+	if key == (taskContextKey{}) {
+		return tc
+	}
+	return tc.Context.Value(key)
+}
+
+// Counter returns the task's counter called name
+// Counts are only added to the job's totals if the task succeeds.
+func (tc *TaskContext) Counter(name string) *Counter {
+	return &Counter{tc: tc, name: userCounterPrefix + name}
+}
+
+// Counters returns a copy of the counts reported so far
+func (tc *TaskContext) Counters() Counters {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	counters := make(Counters)
+	counters.Add(tc.counters)
+	return counters
+}
+
+// CounterFrom returns the counter called name of the task running under
+// ctx, for functions such as a ChunkMapFunction that receive a plain
+// context.Context. If ctx does not belong to a task the counts are dropped.
+func CounterFrom(ctx context.Context, name string) *Counter {
+	if tc, ok := ctx.Value(taskContextKey{}).(*TaskContext); ok {
+		return tc.Counter(name)
+	}
+	return &Counter{}
+}
+
+// builtinCounter returns the built-in counter called name of the task
+// running under ctx, for framework code that runs inside a map or reduce
+// function, such as a Job's combiner
+func builtinCounter(ctx context.Context, name string) *Counter {
+	if tc, ok := ctx.Value(taskContextKey{}).(*TaskContext); ok {
+		return &Counter{tc: tc, name: name}
+	}
+	return &Counter{}
+}
+
+// Counter is a named count reported by a map or reduce function
+// It is safe to use from several goroutines.
+type Counter struct {
+	tc   *TaskContext
+	name string
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n int64) {
+	if c.tc == nil {
+		return
+	}
+	c.tc.mu.Lock()
+	defer c.tc.mu.Unlock()
+	c.tc.counters[c.name] += n
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
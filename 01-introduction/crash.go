@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// maybeCrash randomly kills or stalls the current worker process
+// crashRate and stallRate are chances out of 1000
+// It is used by the crash app to exercise the coordinator's fault tolerance
+func maybeCrash(crashRate, stallRate int) {
+	r := rand.Intn(1000)
+	switch {
+	case r < crashRate:
+		// Crash in the middle of the task
+		fmt.Println("crash app: exiting")
+		os.Exit(1)
+	case r < crashRate+stallRate:
+		// Stall for a while, as an overloaded or hung worker would
+		time.Sleep(time.Duration(rand.Intn(1500)) * time.Millisecond)
+	}
+}
+
+// CrashMap behaves like WordCountMap but may crash or stall the worker
+func CrashMap(filename string, contents string) []KeyValue {
+	maybeCrash(330, 330)
+	return WordCountMap(filename, contents)
+}
+
+// CrashReduce behaves like WordCountReduce but may crash or stall the worker
+// It is called once per key, so the chances are much lower than in CrashMap
+func CrashReduce(key string, values []string) string {
+	maybeCrash(10, 10)
+	return WordCountReduce(key, values)
+}
+
+// StraggleMap behaves like WordCountMap, but is slow in workers started
+// with MR_STRAGGLER set, as on an overloaded machine
+// It is used by the straggle app to exercise backup tasks
+func StraggleMap(filename string, contents string) []KeyValue {
+	if os.Getenv("MR_STRAGGLER") != "" {
+		time.Sleep(4 * time.Second)
+	}
+	return WordCountMap(filename, contents)
+}
+
+// VanishReduce behaves like WordCountReduce, but exits the worker if it was
+// started with MR_VANISH set, as a machine that dies holding map output
+// It is used by the vanish app to exercise re-running map tasks whose
+// output can no longer be fetched
+func VanishReduce(key string, values []string) string {
+	if os.Getenv("MR_VANISH") != "" {
+		fmt.Println("vanish app: exiting")
+		os.Exit(1)
+	}
+	return WordCountReduce(key, values)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DistinctApp counts the distinct items in each group, like SQL's
+// COUNT(DISTINCT item) ... GROUP BY group. Each input line is
+// "group<TAB>item"; a line without a tab is an item of the group "all".
+func DistinctApp() App {
+	return App{
+		RecordMap: DistinctMap,
+		Reduce:    DistinctReduce,
+		Combine:   DistinctCombine,
+		Input:     LineInput{},
+	}
+}
+
+// DistinctMap emits (group, item) for each input line
+func DistinctMap(record Record) []KeyValue {
+	if record.Value == "" {
+		return nil
+	}
+	group, item, found := strings.Cut(record.Value, "\t")
+	if !found {
+		group, item = "all", record.Value
+	}
+	return []KeyValue{{Key: group, Value: item}}
+}
+
+// distinctItems returns the distinct items in values, each of which holds
+// one item or several joined by DistinctCombine
+func distinctItems(values []string) map[string]bool {
+	items := make(map[string]bool)
+	for _, value := range values {
+		for _, item := range strings.Split(value, "\n") {
+			items[item] = true
+		}
+	}
+	return items
+}
+
+// DistinctCombine drops duplicate items inside a map task, joining the
+// remaining ones with newlines (which input lines cannot contain)
+func DistinctCombine(key string, values []string) string {
+	items := distinctItems(values)
+	list := make([]string, 0, len(items))
+	for item := range items {
+		list = append(list, item)
+	}
+	sort.Strings(list)
+	return strings.Join(list, "\n")
+}
+
+// DistinctReduce counts the distinct items of a group
+func DistinctReduce(key string, values []string) string {
+	return strconv.Itoa(len(distinctItems(values)))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Encoding selects the on-disk format of intermediate files
+type Encoding string
+
+const (
+	// EncodingJSON writes one JSON object per record; easy to inspect with cat
+	EncodingJSON Encoding = "json"
+	// EncodingBinary writes length-prefixed records in checksummed blocks
+	EncodingBinary Encoding = "binary"
+)
+
+// ErrCorrupt is returned, wrapped with details, when an intermediate file
+// cannot be decoded
+var ErrCorrupt = errors.New("corrupt intermediate data")
+
+// parseEncoding checks an encoding name from the command line
+func parseEncoding(name string) (Encoding, error) {
+	switch e := Encoding(name); e {
+	case EncodingJSON, EncodingBinary:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q (available: json, binary)", name)
+}
+
+// recordWriter writes records to an intermediate file
+// Close flushes buffered records but does not close the underlying writer
+type recordWriter interface {
+	Write(kv KeyValue) error
+	Close() error
+}
+
+// newRecordWriter returns a writer for the given encoding
+// An empty encoding means JSON
+func newRecordWriter(e Encoding, w io.Writer) (recordWriter, error) {
+	switch e {
+	case EncodingJSON, "":
+		bw := bufio.NewWriter(w)
+		return &jsonRecordWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case EncodingBinary:
+		return newBinaryRecordWriter(w)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", e)
+}
+
+// newRecordReader returns a reader for the given encoding
+// An empty encoding means JSON
+func newRecordReader(e Encoding, r io.Reader) (recordReader, error) {
+	switch e {
+	case EncodingJSON, "":
+		return &jsonRecordReader{dec: json.NewDecoder(r)}, nil
+	case EncodingBinary:
+		return newBinaryRecordReader(r)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", e)
+}
+
+// jsonRecordWriter writes records with json.Encoder, one per line
+type jsonRecordWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (jw *jsonRecordWriter) Write(kv KeyValue) error {
+	return jw.enc.Encode(&kv)
+}
+
+func (jw *jsonRecordWriter) Close() error {
+	return jw.w.Flush()
+}
+
+// jsonRecordReader reads records written with json.Encoder
+type jsonRecordReader struct {
+	dec *json.Decoder
+}
+
+func (r *jsonRecordReader) Read() (KeyValue, error) {
+	var kv KeyValue
+	if err := r.dec.Decode(&kv); err != nil {
+		if err == io.EOF {
+			return KeyValue{}, io.EOF // End of file
+		}
+		return KeyValue{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return kv, nil
+}
+
+// The binary format starts with binaryMagic and then holds a sequence of
+// blocks. Each block is
+//
+//	payload length (uint32, big endian)
+//	CRC-32C of the payload (uint32, big endian)
+//	payload: records, each a uvarint key length, the key, a uvarint value length and the value
+//
+// A block is written whenever the payload would pass binaryBlockSize. The
+// file ends with a trailer that looks like an empty block followed by the
+// number of records in the file (uint64, big endian), with the CRC-32C of
+// that count as its checksum, so a file cut off between two blocks is
+// caught too.
+const (
+	binaryMagic     = "MRKV\x02"
+	binaryBlockSize = 64 << 10 // 64KB
+	binaryMaxBlock  = 1 << 30  // refuse absurd lengths from corrupt headers
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// binaryRecordWriter writes the checksummed binary format
+type binaryRecordWriter struct {
+	w       io.Writer
+	block   []byte
+	records uint64 // records written so far, for the trailer
+}
+
+func newBinaryRecordWriter(w io.Writer) (*binaryRecordWriter, error) {
+	if _, err := io.WriteString(w, binaryMagic); err != nil {
+		return nil, err
+	}
+	return &binaryRecordWriter{w: w, block: make([]byte, 0, binaryBlockSize)}, nil
+}
+
+func (bw *binaryRecordWriter) Write(kv KeyValue) error {
+	bw.block = binary.AppendUvarint(bw.block, uint64(len(kv.Key)))
+	bw.block = append(bw.block, kv.Key...)
+	bw.block = binary.AppendUvarint(bw.block, uint64(len(kv.Value)))
+	bw.block = append(bw.block, kv.Value...)
+	bw.records++
+	if len(bw.block) >= binaryBlockSize {
+		return bw.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered records as one block
+func (bw *binaryRecordWriter) flush() error {
+	if len(bw.block) == 0 {
+		return nil
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(bw.block)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(bw.block, crcTable))
+	if _, err := bw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(bw.block); err != nil {
+		return err
+	}
+	bw.block = bw.block[:0]
+	return nil
+}
+
+// Close writes the last block and the trailer
+func (bw *binaryRecordWriter) Close() error {
+	if err := bw.flush(); err != nil {
+		return err
+	}
+	var trailer [16]byte
+	binary.BigEndian.PutUint64(trailer[8:16], bw.records)
+	binary.BigEndian.PutUint32(trailer[4:8], crc32.Checksum(trailer[8:16], crcTable))
+	_, err := bw.w.Write(trailer[:])
+	return err
+}
+
+// binaryRecordReader reads the checksummed binary format
+type binaryRecordReader struct {
+	r       io.Reader
+	block   []byte // payload of the current block
+	pos     int    // read position within block
+	blocks  int    // blocks read so far, for error messages
+	records uint64 // records read so far, checked against the trailer
+	done    bool   // the trailer has been read
+}
+
+func newBinaryRecordReader(r io.Reader) (*binaryRecordReader, error) {
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		// A compressed stream reports its own damage more precisely
+		if errors.Is(err, ErrCorrupt) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: missing header: %v", ErrCorrupt, err)
+	}
+	if string(magic) != binaryMagic {
+		return nil, fmt.Errorf("%w: not a binary intermediate file", ErrCorrupt)
+	}
+	return &binaryRecordReader{r: r}, nil
+}
+
+// nextBlock reads and verifies the next block. It returns io.EOF once it
+// has read a trailer that accounts for every record.
+func (br *binaryRecordReader) nextBlock() error {
+	if br.done {
+		return io.EOF
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(br.r, header[:]); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%w: file ends after block %d without a trailer", ErrCorrupt, br.blocks)
+		}
+		if errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("block %d: %w", br.blocks, err)
+		}
+		return fmt.Errorf("%w: truncated header of block %d", ErrCorrupt, br.blocks)
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if length == 0 {
+		return br.trailer(sum)
+	}
+	if length > binaryMaxBlock {
+		return fmt.Errorf("%w: block %d claims %d bytes", ErrCorrupt, br.blocks, length)
+	}
+
+	if cap(br.block) < int(length) {
+		br.block = make([]byte, length)
+	}
+	br.block = br.block[:length]
+	if _, err := io.ReadFull(br.r, br.block); err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("block %d: %w", br.blocks, err)
+		}
+		return fmt.Errorf("%w: truncated block %d", ErrCorrupt, br.blocks)
+	}
+	if crc32.Checksum(br.block, crcTable) != sum {
+		return fmt.Errorf("%w: checksum mismatch in block %d", ErrCorrupt, br.blocks)
+	}
+	br.pos = 0
+	br.blocks++
+	return nil
+}
+
+// trailer reads the record count that ends the file and checks it
+func (br *binaryRecordReader) trailer(sum uint32) error {
+	var count [8]byte
+	if _, err := io.ReadFull(br.r, count[:]); err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("trailer: %w", err)
+		}
+		return fmt.Errorf("%w: truncated trailer", ErrCorrupt)
+	}
+	if crc32.Checksum(count[:], crcTable) != sum {
+		return fmt.Errorf("%w: checksum mismatch in trailer", ErrCorrupt)
+	}
+	if n := binary.BigEndian.Uint64(count[:]); n != br.records {
+		return fmt.Errorf("%w: trailer counts %d records, read %d", ErrCorrupt, n, br.records)
+	}
+	// Reading to the end also lets a decompressor check its own trailer
+	var extra [1]byte
+	if _, err := io.ReadFull(br.r, extra[:]); err != io.EOF {
+		if errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("after trailer: %w", err)
+		}
+		return fmt.Errorf("%w: data after trailer", ErrCorrupt)
+	}
+	br.done = true
+	return io.EOF
+}
+
+// field reads one uvarint-prefixed string from the current block
+func (br *binaryRecordReader) field() (string, error) {
+	n, size := binary.Uvarint(br.block[br.pos:])
+	if size <= 0 || n > uint64(len(br.block)-br.pos-size) {
+		return "", fmt.Errorf("%w: bad record in block %d", ErrCorrupt, br.blocks-1)
+	}
+	start := br.pos + size
+	br.pos = start + int(n)
+	return string(br.block[start:br.pos]), nil
+}
+
+func (br *binaryRecordReader) Read() (KeyValue, error) {
+	for br.pos >= len(br.block) {
+		if err := br.nextBlock(); err != nil {
+			return KeyValue{}, err
+		}
+	}
+	key, err := br.field()
+	if err != nil {
+		return KeyValue{}, err
+	}
+	value, err := br.field()
+	if err != nil {
+		return KeyValue{}, err
+	}
+	br.records++
+	return KeyValue{Key: key, Value: value}, nil
+}
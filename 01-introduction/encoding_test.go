@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRecords returns n records with keys and values of varied sizes,
+// including empty strings and some too big for one block
+func testRecords(n int) []KeyValue {
+	kvs := make([]KeyValue, n)
+	for i := range kvs {
+		kvs[i] = KeyValue{Key: fmt.Sprintf("key-%05d", i), Value: strings.Repeat("v", i%50)}
+	}
+	kvs[0] = KeyValue{}
+	kvs[1] = KeyValue{Key: "ünïcode\n\"quoted\"", Value: "tab\there"}
+	kvs[n/2].Value = strings.Repeat("large ", 20000)
+	return kvs
+}
+
+// writeRecords encodes kvs as an intermediate file
+func writeRecords(t testing.TB, kvs []KeyValue, e Encoding, c Compression) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newIntermediateWriter(&buf, e, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kvs {
+		if err := w.Write(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readRecords decodes an intermediate file, stopping at the first error
+func readRecords(data []byte, e Encoding) ([]KeyValue, error) {
+	r, err := newIntermediateReader(bufio.NewReader(bytes.NewReader(data)), e)
+	if err != nil {
+		return nil, err
+	}
+	var kvs []KeyValue
+	for {
+		kv, err := r.Read()
+		if err == io.EOF {
+			return kvs, nil
+		}
+		if err != nil {
+			return kvs, err
+		}
+		kvs = append(kvs, kv)
+	}
+}
+
+var testFormats = []struct {
+	e Encoding
+	c Compression
+}{
+	{EncodingJSON, CompressNone},
+	{EncodingJSON, CompressGzip},
+	{EncodingJSON, CompressLZ},
+	{EncodingBinary, CompressNone},
+	{EncodingBinary, CompressGzip},
+	{EncodingBinary, CompressLZ},
+}
+
+func TestRoundTrip(t *testing.T) {
+	want := testRecords(3000)
+	for _, f := range testFormats {
+		t.Run(fmt.Sprintf("%s-%s", f.e, f.c), func(t *testing.T) {
+			got, err := readRecords(writeRecords(t, want, f.e, f.c), f.e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("read back %d records that differ from the %d written", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	for _, f := range testFormats {
+		got, err := readRecords(writeRecords(t, nil, f.e, f.c), f.e)
+		if err != nil || len(got) != 0 {
+			t.Errorf("%s-%s: read %d records, error %v; want none", f.e, f.c, len(got), err)
+		}
+	}
+}
+
+// checkCorrupt fails the test unless reading data reports ErrCorrupt
+func checkCorrupt(t *testing.T, data []byte, e Encoding, what string) {
+	t.Helper()
+	kvs, err := readRecords(data, e)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("%s: read %d records with error %v; want ErrCorrupt", what, len(kvs), err)
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	data := writeRecords(t, testRecords(10000), EncodingBinary, CompressNone)
+
+	// Every block boundary, where a file without a trailer would end cleanly
+	boundaries := 0
+	for pos := len(binaryMagic); pos+8 <= len(data); boundaries++ {
+		length := int(data[pos])<<24 | int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		checkCorrupt(t, data[:pos], EncodingBinary, fmt.Sprintf("cut before block %d", boundaries))
+		if length == 0 {
+			break // the trailer
+		}
+		pos += 8 + length
+	}
+	if boundaries < 3 {
+		t.Fatalf("only %d blocks; the test needs several", boundaries)
+	}
+
+	for _, n := range []int{0, 3, len(binaryMagic) + 4, len(data) / 2, len(data) - 1} {
+		checkCorrupt(t, data[:n], EncodingBinary, fmt.Sprintf("cut at byte %d", n))
+	}
+}
+
+func TestCompressedTruncated(t *testing.T) {
+	for _, f := range testFormats {
+		if f.c == CompressNone {
+			continue
+		}
+		data := writeRecords(t, testRecords(3000), f.e, f.c)
+		for _, n := range []int{len(compressMagic) + 1, len(data) / 3, len(data) / 2, len(data) - 1} {
+			checkCorrupt(t, data[:n], f.e, fmt.Sprintf("%s-%s cut at byte %d", f.e, f.c, n))
+		}
+	}
+}
+
+func TestCorruptedByte(t *testing.T) {
+	for _, f := range testFormats {
+		if f.c == CompressNone && f.e != EncodingBinary {
+			continue // plain JSON has no checksum to catch a changed letter
+		}
+		data := writeRecords(t, testRecords(300), f.e, f.c)
+		for _, pos := range []int{len(data) / 4, len(data) / 2, len(data) - 3} {
+			damaged := append([]byte(nil), data...)
+			damaged[pos] ^= 0x55
+			checkCorrupt(t, damaged, f.e, fmt.Sprintf("%s-%s with byte %d changed", f.e, f.c, pos))
+		}
+	}
+}
+
+func TestLZBlockBoundary(t *testing.T) {
+	// Cut the JSON stream right after its first full block, where the
+	// records inside still read cleanly
+	data := writeRecords(t, testRecords(3000), EncodingJSON, CompressLZ)
+	pos := len(compressMagic) + 1
+	rawLen, n := binary.Uvarint(data[pos:])
+	pos += n
+	compLen, n := binary.Uvarint(data[pos:])
+	pos += n
+	if compLen == 0 {
+		compLen = rawLen
+	}
+	end := pos + int(compLen)
+	if end >= len(data) {
+		t.Fatal("the stream has only one block")
+	}
+	if kvs, _ := readRecords(data[:end], EncodingJSON); len(kvs) == 0 {
+		t.Fatal("no records in the first block")
+	}
+	checkCorrupt(t, data[:end], EncodingJSON, "lz cut after the first block")
+}
+
+func TestJSONBrokenLine(t *testing.T) {
+	data := writeRecords(t, testRecords(10), EncodingJSON, CompressNone)
+	checkCorrupt(t, data[:len(data)/2], EncodingJSON, "cut mid-line")
+	checkCorrupt(t, []byte("not json\n"), EncodingJSON, "not JSON")
+}
+
+// benchRecords look like the output of a word count map: short keys
+// drawn from a small vocabulary, each with the value "1"
+func benchRecords(n int) []KeyValue {
+	kvs := make([]KeyValue, n)
+	for i := range kvs {
+		kvs[i] = KeyValue{Key: fmt.Sprintf("word%d", i*7919%5000), Value: "1"}
+	}
+	return kvs
+}
+
+func BenchmarkIntermediateWrite(b *testing.B) {
+	kvs := benchRecords(100000)
+	for _, f := range testFormats {
+		b.Run(fmt.Sprintf("%s-%s", f.e, f.c), func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = len(writeRecords(b, kvs, f.e, f.c))
+			}
+			b.ReportMetric(float64(size)/float64(len(kvs)), "bytes/record")
+		})
+	}
+}
+
+func BenchmarkIntermediateRead(b *testing.B) {
+	kvs := benchRecords(100000)
+	for _, f := range testFormats {
+		b.Run(fmt.Sprintf("%s-%s", f.e, f.c), func(b *testing.B) {
+			data := writeRecords(b, kvs, f.e, f.c)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := readRecords(data, f.e); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
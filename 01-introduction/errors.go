@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// TaskError reports the failure of one map or reduce task
+// Use errors.As to find the task, and errors.Is to test the cause, for
+// example context.Canceled when the job was cancelled.
+type TaskError struct {
+	Type TaskType
+	ID   int    // map task number or reduce partition number
+	File string // file being read or written when the task failed, if known
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%v task %d: %v", e.Type, e.ID, e.Err)
+	}
+	return fmt.Sprintf("%v task %d: %s: %v", e.Type, e.ID, e.File, e.Err)
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// taskError wraps err in a TaskError for task, naming the file involved
+func taskError(task Task, file string, err error) error {
+	return &TaskError{Type: task.Type, ID: task.ID, File: file, Err: err}
+}
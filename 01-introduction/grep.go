@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// GrepApp returns the distributed grep of the MapReduce paper: the map
+// function emits each input line that matches pattern, keyed by its file
+// and byte offset, and the reduce function copies it to the output
+func GrepApp(pattern *regexp.Regexp) App {
+	return App{
+		RecordMap:       GrepMap(pattern),
+		ReducePartition: reduceGroups(GrepReduce),
+		Input:           LineInput{},
+	}
+}
+
+// GrepMap returns a map function emitting ("file:offset", line) for every
+// line that matches pattern
+func GrepMap(pattern *regexp.Regexp) RecordMapFunction {
+	return func(record Record) []KeyValue {
+		if !pattern.MatchString(record.Value) {
+			return nil
+		}
+		key := fmt.Sprintf("%s:%d", record.File, record.Offset)
+		return []KeyValue{{Key: key, Value: record.Value}}
+	}
+}
+
+// GrepReduce writes the matching lines out unchanged, one record each.
+// A line appears more than once only if its file was given more than once.
+func GrepReduce(key string, values []string) []string {
+	return values
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IndexMap is the map function for building an inverted index
+// It emits (word, filename) once for each distinct word in the file
+func IndexMap(filename string, contents string) []KeyValue {
+	seen := make(map[string]bool)
+	var keyValues []KeyValue
+	for _, word := range splitWords(contents) {
+		if !seen[word] {
+			seen[word] = true
+			keyValues = append(keyValues, KeyValue{Key: word, Value: filename})
+		}
+	}
+	return keyValues
+}
+
+// IndexReduce lists the files that contain a word
+// The result is the number of files followed by their names, comma separated
+func IndexReduce(key string, values []string) string {
+	// A file split into several map tasks reports the word more than once
+	seen := make(map[string]bool)
+	var files []string
+	for _, file := range values {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return fmt.Sprintf("%d %s", len(files), strings.Join(files, ","))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Record is one unit of input handed to the map function
+type Record struct {
+	File   string
+	Offset int64    // byte offset of the record within File
+	Value  string   // the record's text
+	Fields []string // columns of a CSV row (CSV input only)
+}
+
+// RecordMapFunction is an alternative to MapFunction that receives
+// each input record along with where it came from
+type RecordMapFunction func(record Record) []KeyValue
+
+// RecordReader yields the records of one input chunk in order
+// Next returns io.EOF once there are no more records
+type RecordReader interface {
+	Next() (Record, error)
+}
+
+// InputFormat turns an input chunk into records for the map function
+type InputFormat interface {
+	NewReader(chunk FileChunk, r io.Reader) RecordReader
+}
+
+// WholeFileInput hands the map function each file (or chunk of a file) as
+// a single record. It is the default, and matches MapFunction's
+// (filename, contents) arguments.
+type WholeFileInput struct{}
+
+// LineInput hands the map function one line at a time, without the
+// trailing newline, with its byte offset in the file
+type LineInput struct{}
+
+// CSVInput hands the map function one CSV row at a time, split into Fields
+// Rows must not contain quoted newlines when the input is split by size.
+type CSVInput struct {
+	Comma rune // field delimiter; 0 means ','
+}
+
+// JSONLinesInput hands the map function one JSON value per line, checking
+// that each line is valid JSON. Blank lines are skipped.
+type JSONLinesInput struct{}
+
+func init() {
+	// Allow input formats to travel inside a Task over RPC
+	gob.Register(WholeFileInput{})
+	gob.Register(LineInput{})
+	gob.Register(CSVInput{})
+	gob.Register(JSONLinesInput{})
+}
+
+// parseInputFormat builds an input format from its command-line name
+// An empty name returns nil, leaving the choice to the application
+func parseInputFormat(name string) (InputFormat, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "whole":
+		return WholeFileInput{}, nil
+	case "lines":
+		return LineInput{}, nil
+	case "csv":
+		return CSVInput{}, nil
+	case "tsv":
+		return CSVInput{Comma: '\t'}, nil
+	case "jsonl":
+		return JSONLinesInput{}, nil
+	}
+	return nil, fmt.Errorf("unknown input format %q (available: whole, lines, csv, tsv, jsonl)", name)
+}
+
+// countingRecordReader counts the records read through it
+type countingRecordReader struct {
+	r RecordReader
+	n int64
+}
+
+func (cr *countingRecordReader) Next() (Record, error) {
+	record, err := cr.r.Next()
+	if err == nil {
+		cr.n++
+	}
+	return record, err
+}
+
+func (WholeFileInput) NewReader(chunk FileChunk, r io.Reader) RecordReader {
+	return &wholeFileReader{chunk: chunk, r: r}
+}
+
+type wholeFileReader struct {
+	chunk FileChunk
+	r     io.Reader
+	done  bool
+}
+
+func (wr *wholeFileReader) Next() (Record, error) {
+	if wr.done {
+		return Record{}, io.EOF
+	}
+	wr.done = true
+	content, err := io.ReadAll(wr.r)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{File: wr.chunk.File, Offset: wr.chunk.Offset, Value: string(content)}, nil
+}
+
+func (LineInput) NewReader(chunk FileChunk, r io.Reader) RecordReader {
+	return &lineReader{chunk: chunk, r: bufio.NewReader(r), offset: chunk.Offset}
+}
+
+type lineReader struct {
+	chunk  FileChunk
+	r      *bufio.Reader
+	offset int64 // offset of the next line
+}
+
+func (lr *lineReader) Next() (Record, error) {
+	line, err := lr.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return Record{}, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return Record{}, err
+	}
+	record := Record{File: lr.chunk.File, Offset: lr.offset, Value: strings.TrimRight(line, "\r\n")}
+	lr.offset += int64(len(line))
+	return record, nil
+}
+
+func (f CSVInput) NewReader(chunk FileChunk, r io.Reader) RecordReader {
+	cr := csv.NewReader(r)
+	if f.Comma != 0 {
+		cr.Comma = f.Comma
+	}
+	cr.FieldsPerRecord = -1 // rows may differ in length
+	return &csvReader{chunk: chunk, r: cr, comma: string(cr.Comma)}
+}
+
+type csvReader struct {
+	chunk FileChunk
+	r     *csv.Reader
+	comma string
+}
+
+func (cr *csvReader) Next() (Record, error) {
+	offset := cr.r.InputOffset()
+	fields, err := cr.r.Read()
+	if err == io.EOF {
+		return Record{}, io.EOF
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		File:   cr.chunk.File,
+		Offset: cr.chunk.Offset + offset,
+		Value:  strings.Join(fields, cr.comma),
+		Fields: fields,
+	}, nil
+}
+
+func (JSONLinesInput) NewReader(chunk FileChunk, r io.Reader) RecordReader {
+	return &jsonLinesReader{lines: LineInput{}.NewReader(chunk, r)}
+}
+
+type jsonLinesReader struct {
+	lines RecordReader
+}
+
+func (jr *jsonLinesReader) Next() (Record, error) {
+	for {
+		record, err := jr.lines.Next()
+		if err != nil {
+			return Record{}, err
+		}
+		if strings.TrimSpace(record.Value) == "" {
+			continue
+		}
+		if !json.Valid([]byte(record.Value)) {
+			return Record{}, fmt.Errorf("invalid JSON at offset %d", record.Offset)
+		}
+		return record, nil
+	}
+}
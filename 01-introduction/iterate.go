@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StepFunc returns the app and input files of one iteration of an
+// iterative job, given the output files of the iteration before it (the
+// initial files for iteration 1)
+type StepFunc func(iteration int, previous []string) (App, []string, error)
+
+// ConvergedFunc reports whether an iterative job can stop, by comparing
+// the output files of an iteration with those of the iteration before it
+type ConvergedFunc func(iteration int, previous, current []string) (bool, error)
+
+// Iterative reruns a MapReduce job on its own output until Converged says
+// to stop or MaxIterations have run. Iteration i writes TSV output to
+// Dir/iter-i, which becomes the input of iteration i+1; the output of
+// older iterations is removed as soon as it is no longer needed.
+type Iterative struct {
+	Dir           string
+	NReduce       int
+	MaxIterations int
+	Step          StepFunc
+	Converged     ConvergedFunc // nil always runs MaxIterations times
+	Options       []Option      // job options; the output format and directories are set by the driver
+}
+
+// RerunStep is a StepFunc that runs app on the previous iteration's output
+func RerunStep(app App) StepFunc {
+	return func(iteration int, previous []string) (App, []string, error) {
+		return app, previous, nil
+	}
+}
+
+// IterationDir returns the directory holding iteration i's output files
+func (it *Iterative) IterationDir(i int) string {
+	return filepath.Join(it.Dir, fmt.Sprintf("iter-%d", i))
+}
+
+// Run runs iterations starting from the initial files, and returns the
+// output files of the last one and the number of iterations run
+func (it *Iterative) Run(ctx context.Context, initial []string) ([]string, int, error) {
+	if it.MaxIterations < 1 {
+		return nil, 0, fmt.Errorf("iterative job needs at least one iteration, not %d", it.MaxIterations)
+	}
+
+	previous := initial
+	for i := 1; i <= it.MaxIterations; i++ {
+		fmt.Printf("=== Iteration %d ===\n", i)
+		app, inputs, err := it.Step(i, previous)
+		if err != nil {
+			return nil, i, fmt.Errorf("iteration %d: %w", i, err)
+		}
+
+		// Clear out any output left by an earlier run
+		dir := it.IterationDir(i)
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, i, fmt.Errorf("iteration %d: %w", i, err)
+		}
+		opts := append([]Option{}, it.Options...)
+		opts = append(opts,
+			WithApp(app),
+			WithOutputFormat(OutputTSV),
+			WithJobDir(dir),
+			WithOutputDir(dir),
+			WithWorkDir(filepath.Join(dir, "work")),
+		)
+		job := NewMapReduce(app.Map, app.Reduce, it.NReduce, inputs, opts...)
+		if err := job.Run(ctx); err != nil {
+			return nil, i, fmt.Errorf("iteration %d: %w", i, err)
+		}
+		current := job.OutputFiles()
+
+		converged := false
+		if it.Converged != nil {
+			if converged, err = it.Converged(i, previous, current); err != nil {
+				return nil, i, fmt.Errorf("iteration %d: checking convergence: %w", i, err)
+			}
+		}
+		// The initial files belong to the caller
+		if i > 1 {
+			os.RemoveAll(it.IterationDir(i - 1))
+		}
+		if converged {
+			fmt.Printf("Converged after %d iterations\n", i)
+			return current, i, nil
+		}
+		previous = current
+	}
+	fmt.Printf("Stopped after %d iterations without converging\n", it.MaxIterations)
+	return previous, it.MaxIterations, nil
+}
+
+// readLines calls fn for each non-blank line of files, such as the output
+// of an earlier iteration
+func readLines(files []string, fn func(line string) error) error {
+	for _, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if scanner.Text() == "" {
+				continue
+			}
+			if err := fn(scanner.Text()); err != nil {
+				file.Close()
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	return nil
+}
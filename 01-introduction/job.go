@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultWorkDir is where the command line gives each job a directory of
+// its own, named after the job's ID, unless -work-dir says otherwise
+const DefaultWorkDir = "mr-jobs"
+
+// Subdirectories of a job directory
+const (
+	IntermediateDir = "intermediate" // map output read by the reduce tasks
+	OutputDir       = "output"       // the job's results
+	LogDir          = "logs"         // the job log
+)
+
+// NewJobID returns a new job ID made of the current time and a random
+// suffix, such as 20261016-060500-3fa2c1, so IDs sort by start time
+func NewJobID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// checkJobID makes sure a job ID can be used as a directory name
+func checkJobID(id string) error {
+	if id == "" || id == "." || id == ".." || id != filepath.Base(id) {
+		return fmt.Errorf("job ID %q must be a plain file name", id)
+	}
+	return nil
+}
+
+// WithJobID names the job. The default is a new ID from NewJobID
+func WithJobID(id string) Option {
+	return func(mr *MapReduce) {
+		mr.id = id
+	}
+}
+
+// WithJobDir gives the job a directory of its own, with its intermediate
+// files in dir/intermediate, its output in dir/output, and a log in
+// dir/logs, so that jobs with different directories never touch each
+// other's files. Options after it can still move the output elsewhere.
+func WithJobDir(dir string) Option {
+	return func(mr *MapReduce) {
+		mr.jobDir = dir
+		mr.workDir = filepath.Join(dir, IntermediateDir)
+		mr.outputDir = filepath.Join(dir, OutputDir)
+	}
+}
+
+// ID returns the job's ID
+func (mr *MapReduce) ID() string {
+	return mr.id
+}
+
+// Dir returns the job's directory, or "" if it has none
+func (mr *MapReduce) Dir() string {
+	return mr.jobDir
+}
+
+// openLog starts the job log in the job directory, if the job has one
+func (mr *MapReduce) openLog() error {
+	if mr.jobDir == "" || mr.logger != nil {
+		return nil
+	}
+	dir := filepath.Join(mr.jobDir, LogDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating log directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "job.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening job log: %w", err)
+	}
+	mr.logFile = file
+	mr.logger = log.New(file, "", log.LstdFlags|log.Lmicroseconds)
+	return nil
+}
+
+// closeLog closes the job log, if it is open
+func (mr *MapReduce) closeLog() {
+	if mr.logFile != nil {
+		mr.logFile.Close()
+		mr.logFile, mr.logger = nil, nil
+	}
+}
+
+// logf writes a line to the job log, if the job has one
+func (mr *MapReduce) logf(format string, args ...any) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.logger != nil {
+		mr.logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// JoinApp returns a reduce-side join of tab-separated files on their first
+// column. For each key found in at least two files, it writes one row for
+// every way of picking a row from each of those files, with their other
+// columns in file name order, like a SQL inner join. Keys found in only one
+// file are dropped.
+func JoinApp() App {
+	return App{
+		RecordMap:       JoinMap,
+		ReducePartition: reduceGroups(JoinReduce),
+		Input:           LineInput{},
+	}
+}
+
+// JoinMap keys each row by its first column and tags the rest of the row
+// with the file it came from, as "file<TAB>columns"
+func JoinMap(record Record) []KeyValue {
+	if record.Value == "" {
+		return nil
+	}
+	key, rest, _ := strings.Cut(record.Value, "\t")
+	return []KeyValue{{Key: key, Value: record.File + "\t" + rest}}
+}
+
+// JoinReduce joins the tagged rows for one key, returning the other columns
+// of each joined row
+func JoinReduce(key string, values []string) []string {
+	// Group the rows by the file they came from
+	rows := make(map[string][]string)
+	for _, value := range values {
+		file, columns, _ := strings.Cut(value, "\t")
+		rows[file] = append(rows[file], columns)
+	}
+	if len(rows) < 2 {
+		return nil
+	}
+	files := make([]string, 0, len(rows))
+	for file := range rows {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	// Take the cross product one file at a time
+	joined := []string{""}
+	for i, file := range files {
+		var next []string
+		for _, prefix := range joined {
+			for _, columns := range rows[file] {
+				if i > 0 {
+					columns = prefix + "\t" + columns
+				}
+				next = append(next, columns)
+			}
+		}
+		joined = next
+	}
+	return joined
+}
+
+// reduceGroups adapts a reduce function that returns any number of results
+// per key, including none, into a PartitionReduceFunction
+func reduceGroups(reducef func(key string, values []string) []string) PartitionReduceFunction {
+	return func(ctx context.Context, next func() (KeyValue, bool), emit func(KeyValue) error) error {
+		kv, ok := next()
+		for ok {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key := kv.Key
+			var values []string
+			for ok && kv.Key == key {
+				values = append(values, kv.Value)
+				kv, ok = next()
+			}
+			for _, result := range reducef(key, values) {
+				if err := emit(KeyValue{Key: key, Value: result}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
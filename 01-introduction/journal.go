@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// JournalName is the name of the journal file in a job's work directory
+const JournalName = "mr-journal"
+
+// journalHeader is the first line of a journal and describes the job
+type journalHeader struct {
+	ID      string   `json:"id,omitempty"`   // job ID, which names its temporary files
+	Args    []string `json:"args,omitempty"` // command line that started the job
+	NReduce int      `json:"nreduce"`
+	Splits  []Split  `json:"splits"`
+}
+
+// journalEntry records one completed task, the files it published and
+// its counters
+type journalEntry struct {
+	Type     TaskType `json:"type"`
+	ID       int      `json:"id"`
+	Files    []string `json:"files"`
+	Counters Counters `json:"counters,omitempty"`
+}
+
+// journal is an append-only log of a job's progress, one JSON object per
+// line: the header, then an entry per completed task. Each line is synced
+// to disk before the task counts as done, so after a crash the journal
+// lists every task whose output can be reused.
+//
+// The running job holds an exclusive lock on its journal, which the
+// operating system releases if the process dies. A journal that can be
+// locked was therefore left by a dead job, and one that cannot belongs to
+// a job that is still running.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// errJournalBusy reports that a running job holds the lock on a journal
+var errJournalBusy = errors.New("journal is in use by a running job")
+
+// lockJournal opens the journal at path, creating it if create is set, and
+// takes the lock on it without waiting. It fails with errJournalBusy if a
+// running job holds the lock.
+func lockJournal(path string, create bool) (*journal, error) {
+	flags := os.O_WRONLY
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("creating journal: %w", err)
+		}
+		flags |= os.O_CREATE
+	}
+	for {
+		file, err := os.OpenFile(path, flags, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening journal: %w", err)
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, fmt.Errorf("%s: %w", path, errJournalBusy)
+			}
+			return nil, fmt.Errorf("locking journal: %w", err)
+		}
+		// The job that held the lock may have finished and removed the
+		// journal while we waited for it; lock the file now at path instead
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("opening journal: %w", err)
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(opened, current) {
+			return &journal{file: file}, nil
+		}
+		file.Close()
+		if !create {
+			return nil, fmt.Errorf("opening journal: %w", os.ErrNotExist)
+		}
+	}
+}
+
+// start empties the journal and writes its header
+func (j *journal) start(header journalHeader) error {
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return j.append(header)
+}
+
+// size returns the number of bytes in the journal
+func (j *journal) size() (int64, error) {
+	info, err := j.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("reading journal: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// append writes one line to the journal and syncs it to disk
+func (j *journal) append(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return nil
+}
+
+// record notes that a task completed, publishing files
+func (j *journal) record(task Task, files []string, counters Counters) error {
+	return j.append(journalEntry{Type: task.Type, ID: task.ID, Files: files, Counters: counters})
+}
+
+// remove deletes the journal and closes it, releasing the lock
+// The file is deleted first, so no other job can lock it in between.
+func (j *journal) remove() {
+	os.Remove(j.file.Name())
+	j.file.Close()
+}
+
+// close closes the journal without deleting it, releasing the lock
+func (j *journal) close() {
+	j.file.Close()
+}
+
+// readJournal reads the header of the journal at path and the entry of
+// every task it records as completed. A torn last line, left by a crash
+// in the middle of a write, is ignored.
+func readJournal(path string) (journalHeader, map[taskKey]journalEntry, error) {
+	var header journalHeader
+	file, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, fmt.Errorf("reading journal %s: %w", path, err)
+		}
+		return header, nil, fmt.Errorf("journal %s is empty", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, fmt.Errorf("journal %s: bad header: %w", path, err)
+	}
+	done := make(map[taskKey]journalEntry)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break
+		}
+		done[taskKey{entry.Type, entry.ID}] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, fmt.Errorf("reading journal %s: %w", path, err)
+	}
+	return header, done, nil
+}
+
+// ReadJournalArgs returns the command line that started the job whose
+// journal is at path
+func ReadJournalArgs(path string) ([]string, error) {
+	header, _, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Args) == 0 {
+		return nil, fmt.Errorf("journal %s does not record a command line", path)
+	}
+	return header.Args, nil
+}
+
+// LatestJournal returns the path of the most recently written journal in
+// the job directories under root, which belongs to the job that last
+// stopped without finishing. Journals of jobs that are still running are
+// skipped.
+func LatestJournal(root string) (string, error) {
+	paths, _ := filepath.Glob(filepath.Join(root, "*", JournalName))
+	latest := ""
+	var latestTime time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		j, err := lockJournal(path, false)
+		if err != nil {
+			continue // running, or gone since the glob
+		}
+		j.close()
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = path, info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no unfinished job to resume in %s", root)
+	}
+	return latest, nil
+}
+
+// journalPath returns where the job keeps its journal: in the job
+// directory if it has one, otherwise in the work directory
+func (mr *MapReduce) journalPath() string {
+	if mr.jobDir != "" {
+		return filepath.Join(mr.jobDir, JournalName)
+	}
+	return filepath.Join(mr.workDir, JournalName)
+}
+
+// startJournal begins a fresh journal for the job. If the work directory
+// holds the journal of a job that died, that job's leftover intermediate
+// and temporary files are removed first. It fails if a job that is still
+// running keeps its journal there.
+func (mr *MapReduce) startJournal() error {
+	j, err := lockJournal(mr.journalPath(), true)
+	if err != nil {
+		return err
+	}
+	size, err := j.size()
+	if err != nil {
+		j.remove()
+		return err
+	}
+	if size > 0 {
+		fmt.Printf("Removing leftover files of an unfinished job in %s (use resume to continue it instead)\n", filepath.Dir(mr.journalPath()))
+		header, _, _ := readJournal(mr.journalPath())
+		mr.removeLeftovers(header.ID, nil)
+	}
+	if err := j.start(journalHeader{ID: mr.id, Args: mr.args, NReduce: mr.nReduce, Splits: mr.splits}); err != nil {
+		j.remove()
+		return err
+	}
+	mr.journal = j
+	return nil
+}
+
+// loadJournal reads the journal of an unfinished run of the same job and
+// marks the tasks whose output is still complete as done, restoring their
+// counters. Intermediate files that no completed task accounts for are
+// removed, and the journal is rewritten to list only the tasks kept.
+func (mr *MapReduce) loadJournal() error {
+	j, err := lockJournal(mr.journalPath(), false)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no journal to resume from in %s", filepath.Dir(mr.journalPath()))
+	}
+	if err != nil {
+		return err
+	}
+	header, done, err := readJournal(mr.journalPath())
+	if err != nil {
+		j.close()
+		return err
+	}
+	if header.NReduce != mr.nReduce || !reflect.DeepEqual(header.Splits, mr.splits) {
+		j.close()
+		return fmt.Errorf("journal %s belongs to a different job (its inputs or number of reduce tasks differ)", mr.journalPath())
+	}
+
+	if err := j.start(header); err != nil {
+		j.close()
+		return err
+	}
+	mr.journal = j
+
+	keep := make(map[string]bool)
+	for key, entry := range done {
+		if !allExist(entry.Files) {
+			fmt.Printf("Re-running %v task %d: some of its files are missing\n", key.Type, key.ID)
+			continue
+		}
+		task := Task{Type: key.Type, ID: key.ID}
+		if err := j.record(task, entry.Files, entry.Counters); err != nil {
+			return err
+		}
+		mr.done[key] = true
+		mr.addCounters(task, entry.Counters)
+		if key.Type == MapTask {
+			for _, file := range entry.Files {
+				keep[file] = true
+			}
+		}
+	}
+	mr.removeLeftovers(header.ID, keep)
+	return nil
+}
+
+// removeLeftovers deletes the job's intermediate files other than those in
+// keep, and the temporary files of this job and of the job deadID that
+// died, left in the work directory
+func (mr *MapReduce) removeLeftovers(deadID string, keep map[string]bool) {
+	names, _ := filepath.Glob(filepath.Join(mr.workDir, "mr-*-*"))
+	for _, name := range names {
+		var m, r int
+		if _, err := fmt.Sscanf(filepath.Base(name), "mr-%d-%d", &m, &r); err != nil || name != intermediateName(mr.workDir, m, r) {
+			continue
+		}
+		if !keep[name] {
+			os.Remove(name)
+		}
+	}
+	for _, id := range []string{mr.id, deadID} {
+		if id != "" {
+			removeTempFiles(mr.workDir, id)
+			mr.removeOutputTempFiles(id)
+		}
+	}
+}
+
+// allExist reports whether every one of files exists
+func allExist(files []string) bool {
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
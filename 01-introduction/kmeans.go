@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Centroid is the centre of one k-means cluster
+type Centroid struct {
+	ID     string
+	Coords []float64
+}
+
+// KMeansApp returns one iteration of k-means clustering. Each input line
+// is a point, its coordinates separated by commas or spaces. The map
+// function assigns every point to the nearest of centroids, and the
+// reduce function moves each centroid to the mean of its points, writing
+// "id<TAB>x,y,..." lines. A cluster that attracts no points is dropped.
+func KMeansApp(centroids []Centroid) App {
+	return App{
+		MapContext: KMeansMap(centroids),
+		Reduce:     KMeansReduce(centroids),
+		Combine:    KMeansCombine,
+		Input:      LineInput{},
+	}
+}
+
+// parsePoint reads a point's coordinates, separated by commas or spaces
+func parsePoint(s string) ([]float64, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty point")
+	}
+	point := make([]float64, len(fields))
+	for i, field := range fields {
+		x, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad coordinate %q", field)
+		}
+		point[i] = x
+	}
+	return point, nil
+}
+
+// formatPoint writes coordinates as "x,y,..."
+func formatPoint(point []float64) string {
+	coords := make([]string, len(point))
+	for i, x := range point {
+		coords[i] = strconv.FormatFloat(x, 'f', 6, 64)
+	}
+	return strings.Join(coords, ",")
+}
+
+// distance returns the Euclidean distance between two points, treating
+// missing coordinates as 0
+func distance(a, b []float64) float64 {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	var sum float64
+	for i := range a {
+		var y float64
+		if i < len(b) {
+			y = b[i]
+		}
+		sum += (a[i] - y) * (a[i] - y)
+	}
+	return math.Sqrt(sum)
+}
+
+// KMeansMap returns a map function that emits (id of the nearest
+// centroid, "1:point") for each point. The "count:sum" values let the
+// combiner add up points before the reduce phase. Malformed points are
+// skipped and counted in the malformed_points counter.
+func KMeansMap(centroids []Centroid) ContextMapFunction {
+	return func(ctx *TaskContext, record Record) []KeyValue {
+		if strings.TrimSpace(record.Value) == "" || len(centroids) == 0 {
+			return nil
+		}
+		point, err := parsePoint(record.Value)
+		if err != nil {
+			// Skip malformed points rather than failing the whole job
+			ctx.Counter("malformed_points").Inc()
+			return nil
+		}
+		nearest, best := 0, math.Inf(1)
+		for i, c := range centroids {
+			if d := distance(point, c.Coords); d < best {
+				nearest, best = i, d
+			}
+		}
+		return []KeyValue{{Key: centroids[nearest].ID, Value: "1:" + formatPoint(point)}}
+	}
+}
+
+// sumPoints adds up "count:sum" values, returning the total count and sum
+func sumPoints(values []string) (int, []float64) {
+	total := 0
+	var sum []float64
+	for _, value := range values {
+		countText, coords, _ := strings.Cut(value, ":")
+		count, err := strconv.Atoi(countText)
+		if err != nil {
+			continue
+		}
+		point, err := parsePoint(coords)
+		if err != nil {
+			continue
+		}
+		for len(sum) < len(point) {
+			sum = append(sum, 0)
+		}
+		for i, x := range point {
+			sum[i] += x
+		}
+		total += count
+	}
+	return total, sum
+}
+
+// KMeansCombine adds up a cluster's points within a map task
+func KMeansCombine(key string, values []string) string {
+	count, sum := sumPoints(values)
+	return strconv.Itoa(count) + ":" + formatPoint(sum)
+}
+
+// KMeansReduce returns a reduce function giving the mean of a cluster's
+// points, its new centroid. A cluster whose values hold no valid points
+// keeps its centroid from centroids rather than becoming NaN.
+func KMeansReduce(centroids []Centroid) ReduceFunction {
+	previous := make(map[string][]float64, len(centroids))
+	for _, c := range centroids {
+		previous[c.ID] = c.Coords
+	}
+	return func(key string, values []string) string {
+		count, sum := sumPoints(values)
+		if count == 0 {
+			return formatPoint(previous[key])
+		}
+		for i := range sum {
+			sum[i] /= float64(count)
+		}
+		return formatPoint(sum)
+	}
+}
+
+// KMeansStep returns a StepFunc that clusters the points in files around
+// the centroids written by the previous iteration
+func KMeansStep(files []string) StepFunc {
+	return func(iteration int, previous []string) (App, []string, error) {
+		centroids, err := readCentroids(previous)
+		if err != nil {
+			return App{}, nil, err
+		}
+		if len(centroids) == 0 {
+			return App{}, nil, fmt.Errorf("no centroids in %v", previous)
+		}
+		return KMeansApp(centroids), files, nil
+	}
+}
+
+// KMeansConverged returns a ConvergedFunc that stops once no centroid moved
+// by epsilon or more in an iteration
+func KMeansConverged(epsilon float64) ConvergedFunc {
+	return func(iteration int, previous, current []string) (bool, error) {
+		before, err := readCentroids(previous)
+		if err != nil {
+			return false, err
+		}
+		after, err := readCentroids(current)
+		if err != nil {
+			return false, err
+		}
+		coords := make(map[string][]float64)
+		for _, c := range before {
+			coords[c.ID] = c.Coords
+		}
+		var moved float64
+		for _, c := range after {
+			old, ok := coords[c.ID]
+			if !ok {
+				return false, nil
+			}
+			moved = math.Max(moved, distance(old, c.Coords))
+		}
+		fmt.Printf("Largest centroid move: %.6f\n", moved)
+		return len(after) == len(before) && moved < epsilon, nil
+	}
+}
+
+// readCentroids reads "id<TAB>x,y,..." lines, returning the centroids in ID order
+func readCentroids(files []string) ([]Centroid, error) {
+	var centroids []Centroid
+	err := readLines(files, func(line string) error {
+		id, coords, found := strings.Cut(line, "\t")
+		if !found {
+			return fmt.Errorf("centroid line %q has no tab", line)
+		}
+		point, err := parsePoint(coords)
+		if err != nil {
+			return fmt.Errorf("centroid %s: %w", id, err)
+		}
+		centroids = append(centroids, Centroid{ID: id, Coords: point})
+		return nil
+	})
+	sort.Slice(centroids, func(i, j int) bool {
+		a, errA := strconv.Atoi(centroids[i].ID)
+		b, errB := strconv.Atoi(centroids[j].ID)
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return centroids[i].ID < centroids[j].ID
+	})
+	return centroids, err
+}
+
+// WriteInitialCentroids picks the first k distinct points in files as the
+// starting centroids and writes them to filename, numbered from 0
+func WriteInitialCentroids(filename string, files []string, k int) error {
+	if k < 1 {
+		return fmt.Errorf("k-means needs at least one cluster, not %d", k)
+	}
+	var centroids []string
+	seen := make(map[string]bool)
+	err := readLines(files, func(line string) error {
+		point, err := parsePoint(line)
+		if err != nil || len(centroids) == k {
+			return nil
+		}
+		if p := formatPoint(point); !seen[p] {
+			seen[p] = true
+			centroids = append(centroids, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(centroids) < k {
+		return fmt.Errorf("only %d distinct points for %d clusters", len(centroids), k)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for i, c := range centroids {
+		fmt.Fprintf(w, "%d\t%s\n", i, c)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestKMeansReduce(t *testing.T) {
+	reduce := KMeansReduce([]Centroid{{ID: "0", Coords: []float64{1, 2}}})
+	if got, want := reduce("0", []string{"1:1,1", "2:2,4"}), "1.000000,1.666667"; got != want {
+		t.Errorf("mean of the points is %q; want %q", got, want)
+	}
+	// No valid point: keep the centroid instead of dividing by zero
+	for _, values := range [][]string{{"0:0,0"}, {"x:1,1", "1:bad"}} {
+		if got, want := reduce("0", values), "1.000000,2.000000"; got != want {
+			t.Errorf("centroid for %q is %q; want %q", values, got, want)
+		}
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"time"
 )
 
-// KeyValue represents a key-value pair used throughout MapReduce
-type KeyValue struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
+// KeyValue represents a key-value pair used throughout MapReduce. It is
+// the Pair of a Job[string, string, string], which the string API runs as.
+type KeyValue = Pair[string, string]
 
 // MapFunction is the interface that user-defined map functions must implement
 // It takes a filename and its contents, and returns a slice of KeyValue pairs
@@ -23,22 +26,257 @@ type MapFunction func(filename string, contents string) []KeyValue
 // It takes a key and a slice of values for that key, and returns a single value
 type ReduceFunction func(key string, values []string) string
 
+// StreamReduceFunction is an alternative to ReduceFunction for keys with
+// too many values to hold in memory. The values are streamed through an
+// iterator in the order they were emitted.
+type StreamReduceFunction func(key string, values *ValueIterator) string
+
+// ContextMapFunction is an alternative to RecordMapFunction for map
+// functions that report counters, for example
+// ctx.Counter("malformed_lines").Inc()
+type ContextMapFunction func(ctx *TaskContext, record Record) []KeyValue
+
+// ContextReduceFunction is an alternative to ReduceFunction for reduce
+// functions that report counters through ctx
+type ContextReduceFunction func(ctx *TaskContext, key string, values []string) string
+
+// CombineFunction is an optional function run on the map output of each
+// input chunk before it is written to disk. It merges all values for a key into one,
+// so it must be safe to apply before the reduce function (for example a
+// sum or a maximum).
+type CombineFunction func(key string, values []string) string
+
+// ChunkMapFunction is an alternative to MapFunction for mappers that handle
+// a whole input chunk at once, such as an external program. It reads the
+// chunk's records and returns every pair they produce.
+type ChunkMapFunction func(ctx context.Context, chunk FileChunk, records RecordReader) ([]KeyValue, error)
+
+// PartitionReduceFunction is an alternative to ReduceFunction for reducers
+// that handle a whole reduce task at once, such as an external program.
+// next returns the partition's records in key order, and each result is
+// passed to emit; there may be any number of results per key.
+type PartitionReduceFunction func(ctx context.Context, next func() (KeyValue, bool), emit func(KeyValue) error) error
+
 // MapReduce represents our MapReduce coordinator
 type MapReduce struct {
-	mapFunc    MapFunction
-	reduceFunc ReduceFunction
-	nReduce    int // number of reduce tasks
-	inputFiles []string
+	id          string // job ID
+	jobDir      string // directory holding all of the job's files; "" if it has none
+	app         App
+	nReduce     int // number of reduce tasks
+	inputFiles  []string
+	splitSize   int64   // target bytes per map task; 0 means one task per file
+	splits      []Split // map task inputs, computed on first use
+	parallelism int     // maximum number of tasks run at once
+	memory      int64   // memory budget of each reduce task's merge, in bytes
+	partitioner Partitioner
+	input       InputFormat // how input chunks are cut into records
+	workDir     string      // directory of intermediate files
+	encoding    Encoding    // format of intermediate files
+	compression Compression // codec for intermediate files
+
+	outputFormat  OutputFormat // how reduce results are written
+	outputDir     string       // directory of the output files
+	outputPattern string       // output file name, with a verb for the reduce task number
+
+	args    []string         // command line that started the job, kept in the journal
+	journal *journal         // progress of the running job; nil if none is kept
+	done    map[taskKey]bool // tasks finished by an earlier run, skipped on resume
+	logFile *os.File         // job log in the job directory; nil if there is none
+	logger  *log.Logger
+
+	mu           sync.Mutex
+	counters     Counters             // totals over all completed tasks
+	taskCounters map[taskKey]Counters // counters of each completed task
+}
+
+// Option configures optional behaviour of a MapReduce job
+type Option func(*MapReduce)
+
+// WithParallelism sets how many map or reduce tasks may run at the same time
+// The default of 1 runs every task sequentially
+func WithParallelism(n int) Option {
+	return func(mr *MapReduce) {
+		if n > 0 {
+			mr.parallelism = n
+		}
+	}
+}
+
+// WithSplitSize sets the target size in bytes of each map task's input
+// Larger files are cut on line boundaries and smaller ones are combined.
+// The default of 0 makes one map task per input file
+func WithSplitSize(bytes int64) Option {
+	return func(mr *MapReduce) {
+		mr.splitSize = bytes
+	}
+}
+
+// WithMemoryBudget limits how much memory each reduce task may use to
+// buffer its inputs. Reduce tasks with more intermediate files than fit
+// in the budget merge them in several passes, spilling to disk.
+func WithMemoryBudget(bytes int64) Option {
+	return func(mr *MapReduce) {
+		if bytes > 0 {
+			mr.memory = bytes
+		}
+	}
+}
+
+// WithStreamReducer replaces the reduce function with one that receives
+// each key's values through an iterator
+func WithStreamReducer(reduceFunc StreamReduceFunction) Option {
+	return func(mr *MapReduce) {
+		mr.app.StreamReduce = reduceFunc
+	}
+}
+
+// WithRecordMapper replaces the map function with one that receives each
+// input record along with its file and offset
+func WithRecordMapper(mapFunc RecordMapFunction) Option {
+	return func(mr *MapReduce) {
+		mr.app.RecordMap = mapFunc
+	}
+}
+
+// WithChunkMapper replaces the map function with one that handles a whole
+// input chunk at once
+func WithChunkMapper(mapFunc ChunkMapFunction) Option {
+	return func(mr *MapReduce) {
+		mr.app.MapChunk = mapFunc
+	}
+}
+
+// WithPartitionReducer replaces the reduce function with one that handles
+// a whole reduce task at once
+func WithPartitionReducer(reduceFunc PartitionReduceFunction) Option {
+	return func(mr *MapReduce) {
+		mr.app.ReducePartition = reduceFunc
+	}
+}
+
+// WithPartitioner chooses how keys are assigned to reduce tasks
+// The default is HashPartitioner
+func WithPartitioner(p Partitioner) Option {
+	return func(mr *MapReduce) {
+		mr.partitioner = p
+	}
+}
+
+// WithInputFormat chooses how input files are read into records for the
+// map function. The default is WholeFileInput
+func WithInputFormat(f InputFormat) Option {
+	return func(mr *MapReduce) {
+		mr.input = f
+	}
+}
+
+// WithEncoding chooses the format of intermediate files
+// The default is EncodingJSON
+func WithEncoding(e Encoding) Option {
+	return func(mr *MapReduce) {
+		mr.encoding = e
+	}
+}
+
+// WithCompression compresses intermediate files with the given codec
+// The default is CompressNone
+func WithCompression(c Compression) Option {
+	return func(mr *MapReduce) {
+		mr.compression = c
+	}
+}
+
+// WithOutputFormat chooses how reduce tasks write their results
+// The default is OutputText
+func WithOutputFormat(f OutputFormat) Option {
+	return func(mr *MapReduce) {
+		mr.outputFormat = f
+	}
+}
+
+// WithOutputDir writes the output files into dir, which is created if needed
+// The default is the current directory
+func WithOutputDir(dir string) Option {
+	return func(mr *MapReduce) {
+		mr.outputDir = dir
+	}
+}
+
+// WithOutputPattern names the output files by formatting the reduce task
+// number with pattern, for example "part-%05d.csv". The default is
+// DefaultOutputPattern
+func WithOutputPattern(pattern string) Option {
+	return func(mr *MapReduce) {
+		mr.outputPattern = pattern
+	}
+}
+
+// WithWorkDir keeps the job's intermediate files in dir, which is created
+// if needed, so that jobs sharing a directory do not collide. The default
+// is the current directory
+func WithWorkDir(dir string) Option {
+	return func(mr *MapReduce) {
+		mr.workDir = dir
+	}
+}
+
+// WithApp uses every function and setting of app, replacing the map and
+// reduce functions given to NewMapReduce. The app's input format and
+// partitioner apply when the job does not choose its own
+func WithApp(app App) Option {
+	return func(mr *MapReduce) {
+		mr.app = app
+	}
+}
+
+// WithCommand records the command line that started the job in its
+// journal, so that the resume command can start it again
+func WithCommand(args []string) Option {
+	return func(mr *MapReduce) {
+		mr.args = args
+	}
+}
+
+// WithCombiner sets a combine function to run on each input chunk's map output
+func WithCombiner(combineFunc CombineFunction) Option {
+	return func(mr *MapReduce) {
+		mr.app.Combine = combineFunc
+	}
 }
 
 // NewMapReduce creates a new MapReduce instance
-func NewMapReduce(mapFunc MapFunction, reduceFunc ReduceFunction, nReduce int, inputFiles []string) *MapReduce {
-	return &MapReduce{
-		mapFunc:    mapFunc,
-		reduceFunc: reduceFunc,
-		nReduce:    nReduce,
-		inputFiles: inputFiles,
+func NewMapReduce(mapFunc MapFunction, reduceFunc ReduceFunction, nReduce int, inputFiles []string, opts ...Option) *MapReduce {
+	mr := &MapReduce{
+		id:          NewJobID(),
+		app:         App{Map: mapFunc, Reduce: reduceFunc},
+		nReduce:     nReduce,
+		inputFiles:  inputFiles,
+		parallelism: 1,
+		memory:      DefaultMemoryBudget,
+		encoding:    EncodingJSON,
+		compression: CompressNone,
+		counters:    make(Counters),
+
+		taskCounters: make(map[taskKey]Counters),
+		done:         make(map[taskKey]bool),
+
+		outputFormat:  OutputText,
+		outputDir:     ".",
+		workDir:       ".",
+		outputPattern: DefaultOutputPattern,
 	}
+	for _, opt := range opts {
+		opt(mr)
+	}
+	return mr
+}
+
+// checkNReduce makes sure a job has at least one reduce task
+func checkNReduce(nReduce int) error {
+	if nReduce < 1 {
+		return fmt.Errorf("a job needs at least one reduce task, not %d", nReduce)
+	}
+	return nil
 }
 
 // hash function to determine which reduce task should handle a key
@@ -48,143 +286,644 @@ func ihash(key string) int {
 	return int(h.Sum32())
 }
 
-// RunMapPhase executes the map phase
-// For each input file, it runs the map function and partitions the output
-func (mr *MapReduce) RunMapPhase() {
-	fmt.Println("=== Starting Map Phase ===")
+// intermediateName returns the path of the file in dir holding map task
+// m's output for reduce task r
+func intermediateName(dir string, m, r int) string {
+	return filepath.Join(dir, fmt.Sprintf("mr-%d-%d", m, r))
+}
 
-	for i, filename := range mr.inputFiles {
-		fmt.Printf("Processing file %d: %s\n", i, filename)
+// OutputFiles returns the paths of the job's output files, one per reduce task
+func (mr *MapReduce) OutputFiles() []string {
+	names := make([]string, mr.nReduce)
+	for r := range names {
+		names[r] = outputName(mr.outputDir, mr.outputPattern, r)
+	}
+	return names
+}
 
-		// Read the input file
-		content, err := os.ReadFile(filename)
+// Splits returns the inputs of the job's map tasks, dividing the input
+// files into splits the first time it is called
+func (mr *MapReduce) Splits() ([]Split, error) {
+	if mr.splits == nil {
+		splits, err := ComputeSplits(mr.inputFiles, mr.splitSize)
 		if err != nil {
-			log.Fatalf("Error reading file %s: %v", filename, err)
+			return nil, fmt.Errorf("splitting input: %w", err)
 		}
+		mr.splits = splits
+	}
+	return mr.splits, nil
+}
 
-		// Run the map function
-		keyValues := mr.mapFunc(filename, string(content))
-		fmt.Printf("  Map produced %d key-value pairs\n", len(keyValues))
+// mapTask builds the description of map task i
+func (mr *MapReduce) mapTask(i int) Task {
+	return Task{
+		Type:        MapTask,
+		ID:          i,
+		Split:       mr.splits[i],
+		NMap:        len(mr.splits),
+		NReduce:     mr.nReduce,
+		Partitioner: mr.partitioner,
+		InputFormat: mr.input,
+		WorkDir:     mr.workDir,
+		JobID:       mr.id,
+		Encoding:    mr.encoding,
+		Compression: mr.compression,
+	}
+}
 
-		// Partition the output into intermediate files for each reduce task
-		buckets := make([][]KeyValue, mr.nReduce)
-		for _, kv := range keyValues {
-			// Use hash function to determine which reduce task gets this key
-			bucket := ihash(kv.Key) % mr.nReduce
-			buckets[bucket] = append(buckets[bucket], kv)
-		}
+// reduceTask builds the description of reduce task r
+func (mr *MapReduce) reduceTask(r int) Task {
+	return Task{
+		Type:         ReduceTask,
+		ID:           r,
+		NMap:         len(mr.splits),
+		NReduce:      mr.nReduce,
+		WorkDir:      mr.workDir,
+		JobID:        mr.id,
+		MemoryBudget: mr.memory,
+		Encoding:     mr.encoding,
+		Compression:  mr.compression,
 
-		// Write each bucket to an intermediate file
-		for r := 0; r < mr.nReduce; r++ {
-			filename := fmt.Sprintf("mr-%d-%d", i, r)
-			file, err := os.Create(filename)
-			if err != nil {
-				log.Fatalf("Error creating intermediate file %s: %v", filename, err)
-			}
+		OutputFormat:  mr.outputFormat,
+		OutputDir:     mr.outputDir,
+		OutputPattern: mr.outputPattern,
+	}
+}
 
-			enc := json.NewEncoder(file)
-			for _, kv := range buckets[r] {
-				if err := enc.Encode(&kv); err != nil {
-					log.Fatalf("Error encoding to intermediate file: %v", err)
-				}
-			}
-			file.Close()
-			fmt.Printf("  Created intermediate file: %s (%d pairs)\n", filename, len(buckets[r]))
+// combine groups kvs by key and merges each group with combinef
+// The result holds one KeyValue per distinct key, in key order
+func combine(combinef CombineFunction, kvs []KeyValue) []KeyValue {
+	groups := make(map[string][]string)
+	var keys []string
+	for _, kv := range kvs {
+		if _, ok := groups[kv.Key]; !ok {
+			keys = append(keys, kv.Key)
 		}
+		groups[kv.Key] = append(groups[kv.Key], kv.Value)
 	}
-	fmt.Println("=== Map Phase Complete ===")
+	sort.Strings(keys)
+
+	combined := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		combined = append(combined, KeyValue{Key: key, Value: combinef(key, groups[key])})
+	}
+	return combined
 }
 
-// RunReducePhase executes the reduce phase
-// For each reduce task, it collects all intermediate files and runs the reduce function
-func (mr *MapReduce) RunReducePhase() {
-	fmt.Println("=== Starting Reduce Phase ===")
+// mapChunk streams the records of one input chunk through the map function
+// It returns the map output and the number of records read. Apps without
+// a ChunkMapFunction run as a Job[string, string, string], which also
+// applies their combiner.
+func mapChunk(ctx *TaskContext, app App, input InputFormat, chunk FileChunk) ([]KeyValue, int64, error) {
+	r, closeChunk, err := openChunk(chunk)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeChunk()
 
-	for r := 0; r < mr.nReduce; r++ {
-		fmt.Printf("Running reduce task %d\n", r)
+	mapf := app.MapChunk
+	if mapf == nil {
+		mapf = stringJob(ctx, app).mapChunk
+	}
+	counted := &countingRecordReader{r: input.NewReader(chunk, r)}
+	keyValues, err := mapf(ctx, chunk, counted)
+	return keyValues, counted.n, err
+}
+
+// doMap executes a single map task
+// It runs the map function over each chunk of the task's input split and
+// partitions the output into one intermediate file per reduce task.
+// Errors are *TaskError. If ctx is cancelled the task stops and removes
+// any files it had started.
+func doMap(ctx context.Context, app App, task Task) (Counters, error) {
+	counters := make(Counters)
+	tc := newTaskContext(ctx, task)
+
+	input := task.InputFormat
+	if input == nil {
+		input = app.Input
+	}
+	if input == nil {
+		input = WholeFileInput{}
+	}
+
+	var keyValues []KeyValue
+	for _, chunk := range task.Split.Chunks {
+		kvs, records, err := mapChunk(tc, app, input, chunk)
+		if err != nil {
+			return nil, taskError(task, chunk.String(), err)
+		}
+		counters[MapInputBytes] += chunk.Length
+		counters[MapInputRecords] += records
+		keyValues = append(keyValues, kvs...)
+	}
+	// Pairs that a job's combiner has already merged still count as map
+	// output, as they do when the combiner runs below
+	combined := tc.Counters()
+	counters[MapOutputRecords] += int64(len(keyValues)) + combined[CombineInputRecords] - combined[CombineOutputRecords]
+	fmt.Printf("  Map produced %d key-value pairs\n", counters[MapOutputRecords])
+
+	// Partition the output into intermediate files for each reduce task
+	partitioner := task.Partitioner
+	if partitioner == nil {
+		partitioner = app.Partitioner
+	}
+	if partitioner == nil {
+		partitioner = HashPartitioner{}
+	}
+	buckets := make([][]KeyValue, task.NReduce)
+	for _, kv := range keyValues {
+		// Ask the partitioner which reduce task gets this key
+		bucket := partitioner.Partition(kv.Key, task.NReduce)
+		if bucket < 0 || bucket >= task.NReduce {
+			return nil, taskError(task, "", fmt.Errorf("partitioner sent key %q to reduce task %d of %d", kv.Key, bucket, task.NReduce))
+		}
+		buckets[bucket] = append(buckets[bucket], kv)
+	}
 
-		// Collect all intermediate files for this reduce task
-		var keyValues []KeyValue
-		for m := 0; m < len(mr.inputFiles); m++ {
-			filename := fmt.Sprintf("mr-%d-%d", m, r)
+	// Sort each bucket so reduce tasks can merge the files instead of
+	// loading them, then shrink it with the combiner before it hits the
+	// disk. Only a ChunkMapFunction's output is combined here; other apps
+	// were combined chunk by chunk in mapChunk.
+	for r := range buckets {
+		bucket := buckets[r]
+		sort.SliceStable(bucket, func(i, j int) bool { return bucket[i].Key < bucket[j].Key })
+	}
+	if app.MapChunk != nil && app.Combine != nil {
+		for r := range buckets {
+			counters[CombineInputRecords] += int64(len(buckets[r]))
+			buckets[r] = combine(app.Combine, buckets[r])
+			counters[CombineOutputRecords] += int64(len(buckets[r]))
+		}
+	}
+
+	// Write each bucket to a temporary file, and only publish them as
+	// intermediate files once every bucket has been written
+	if err := os.MkdirAll(task.WorkDir, 0o755); err != nil {
+		return nil, taskError(task, task.WorkDir, fmt.Errorf("creating work directory: %w", err))
+	}
+	files := make([]*atomicFile, 0, task.NReduce)
+	abort := func() {
+		for _, file := range files {
+			file.Abort()
+		}
+	}
+	for r := 0; r < task.NReduce; r++ {
+		filename := intermediateName(task.WorkDir, task.ID, r)
+		if err := ctx.Err(); err != nil {
+			abort()
+			return nil, taskError(task, filename, err)
+		}
+		file, err := createAtomic(filename, task.JobID)
+		if err != nil {
+			abort()
+			return nil, taskError(task, filename, fmt.Errorf("creating: %w", err))
+		}
+		files = append(files, file)
 
-			// Check if file exists (some might be empty)
-			if _, err := os.Stat(filename); os.IsNotExist(err) {
-				continue
+		cw := &countingWriter{w: file}
+		w, err := newIntermediateWriter(cw, task.Encoding, task.Compression)
+		if err != nil {
+			abort()
+			return nil, taskError(task, filename, err)
+		}
+		for _, kv := range buckets[r] {
+			if err := w.Write(kv); err != nil {
+				abort()
+				return nil, taskError(task, filename, fmt.Errorf("writing: %w", err))
 			}
+		}
+		if err := w.Close(); err != nil {
+			abort()
+			return nil, taskError(task, filename, fmt.Errorf("writing: %w", err))
+		}
+		counters[IntermediateBytes] += cw.n
+	}
+	if err := mayCommit(ctx); err != nil {
+		abort()
+		return nil, taskError(task, "", err)
+	}
+	for r, file := range files {
+		if err := file.Commit(); err != nil {
+			abort()
+			return nil, taskError(task, file.name, err)
+		}
+		fmt.Printf("  Created intermediate file: %s (%d pairs)\n", file.name, len(buckets[r]))
+	}
+	counters.Add(tc.Counters())
+	return counters, nil
+}
+
+// doReduce executes a single reduce task
+// It merges the task's partition from every map task's sorted intermediate
+// files and streams each key's values to the reduce function.
+// Errors are *TaskError. If ctx is cancelled the task stops and removes
+// its spill files and partial output.
+func doReduce(ctx context.Context, app App, task Task) (Counters, error) {
+	counters := make(Counters)
+	tc := newTaskContext(ctx, task)
 
-			file, err := os.Open(filename)
+	// Collect all intermediate files for this reduce task, fetching those
+	// held by other workers into the work directory first
+	var runs, fetched []string
+	defer func() {
+		for _, filename := range fetched {
+			os.Remove(filename)
+		}
+	}()
+	for m := 0; m < task.NMap; m++ {
+		if m < len(task.MapAddrs) && task.MapAddrs[m] != "" {
+			if err := os.MkdirAll(task.WorkDir, 0o755); err != nil {
+				return nil, taskError(task, task.WorkDir, fmt.Errorf("creating work directory: %w", err))
+			}
+			filename, n, err := fetchPartition(ctx, task, m)
 			if err != nil {
-				log.Fatalf("Error opening intermediate file %s: %v", filename, err)
+				return nil, taskError(task, "", err)
 			}
+			fetched = append(fetched, filename)
+			runs = append(runs, filename)
+			counters[ShuffleFetchedBytes] += n
+			continue
+		}
+		filename := intermediateName(task.WorkDir, m, task.ID)
 
-			dec := json.NewDecoder(file)
-			for {
-				var kv KeyValue
-				if err := dec.Decode(&kv); err != nil {
-					break // End of file
-				}
-				keyValues = append(keyValues, kv)
+		// Check if file exists (some might be empty)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			continue
+		}
+		runs = append(runs, filename)
+	}
+
+	// Merge in several passes if the files do not fit in the memory budget
+	runs, spills, err := shrinkRuns(ctx, task, runs, mergeFanIn(task))
+	defer func() {
+		for _, spill := range spills {
+			os.Remove(spill)
+		}
+	}()
+	if err != nil {
+		return nil, taskError(task, "", err)
+	}
+	if len(spills) > 0 {
+		fmt.Printf("  Spilled %d merged runs to disk\n", len(spills))
+	}
+
+	readers, closeAll, err := openRuns(runs, task.Encoding)
+	if err != nil {
+		return nil, taskError(task, "", err)
+	}
+	defer closeAll()
+	merge := newMergeIterator(readers)
+
+	// Run reduce function for each key and write output to a temporary
+	// file, published under its final name only once it is complete
+	outputFilename := outputName(task.OutputDir, task.OutputPattern, task.ID)
+	if err := os.MkdirAll(filepath.Dir(outputFilename), 0o755); err != nil {
+		return nil, taskError(task, outputFilename, fmt.Errorf("creating output directory: %w", err))
+	}
+	file, err := createAtomic(outputFilename, task.JobID)
+	if err != nil {
+		return nil, taskError(task, outputFilename, fmt.Errorf("creating: %w", err))
+	}
+	w, err := newOutputWriter(task.OutputFormat, file)
+	if err != nil {
+		file.Abort()
+		return nil, taskError(task, outputFilename, err)
+	}
+
+	// Apps without a PartitionReduceFunction run as a Job[string, string,
+	// string], unless they stream each key's values
+	reduce := app.ReducePartition
+	if reduce == nil && (app.StreamReduce == nil || app.ReduceContext != nil) {
+		reduce = stringJob(tc, app).reducePartition
+	}
+
+	var records, results int64
+	if reduce != nil {
+		next := func() (KeyValue, bool) {
+			kv, ok := merge.Next()
+			if ok {
+				records++
 			}
-			file.Close()
+			return kv, ok
 		}
+		emit := func(kv KeyValue) error {
+			results++
+			return w.Write(kv)
+		}
+		if err := reduce(tc, next, emit); err != nil {
+			file.Abort()
+			return nil, taskError(task, outputFilename, err)
+		}
+	} else {
+		groups := newGroupIterator(merge)
+		for key, values, ok := groups.NextKey(); ok; key, values, ok = groups.NextKey() {
+			if err := ctx.Err(); err != nil {
+				file.Abort()
+				return nil, taskError(task, outputFilename, err)
+			}
+			result := app.StreamReduce(key, values)
+			if err := w.Write(KeyValue{Key: key, Value: result}); err != nil {
+				file.Abort()
+				return nil, taskError(task, outputFilename, fmt.Errorf("writing: %w", err))
+			}
+			results++
+		}
+		records = groups.records
+	}
+	if err := merge.Err(); err != nil {
+		file.Abort()
+		return nil, taskError(task, "", err)
+	}
+	if err := w.Close(); err != nil {
+		file.Abort()
+		return nil, taskError(task, outputFilename, fmt.Errorf("writing: %w", err))
+	}
+	if err := mayCommit(ctx); err != nil {
+		file.Abort()
+		return nil, taskError(task, outputFilename, err)
+	}
+	if err := file.Commit(); err != nil {
+		return nil, taskError(task, outputFilename, err)
+	}
+	counters[ReduceInputRecords] += records
+	counters[ReduceOutputRecords] += results
+	counters.Add(tc.Counters())
 
-		fmt.Printf("  Collected %d key-value pairs\n", len(keyValues))
+	fmt.Printf("  Merged %d key-value pairs from %d files\n", records, len(runs))
+	fmt.Printf("  Created output file: %s (%d results)\n", outputFilename, results)
+	return counters, nil
+}
+
+// runTasks runs task(0) .. task(n-1) using at most parallelism goroutines
+// It waits for every task to finish and returns all of their errors joined
+// together. Once ctx is cancelled no more tasks are started.
+func runTasks(ctx context.Context, n, parallelism int, task func(i int) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, parallelism)
 
-		// Group by key
-		keyGroups := make(map[string][]string)
-		for _, kv := range keyValues {
-			keyGroups[kv.Key] = append(keyGroups[kv.Key], kv.Value)
+	for i := 0; i < n; i++ {
+		// Wait for a free slot
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
 		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := task(i); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(errs) == 0 && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+// addCounters records a finished task's counters and folds them into the
+// job totals
+func (mr *MapReduce) addCounters(task Task, counters Counters) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.taskCounters[taskKey{task.Type, task.ID}] = counters
+	mr.counters.Add(counters)
+}
+
+// Counters returns a copy of the job's counters
+func (mr *MapReduce) Counters() Counters {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	counters := make(Counters)
+	counters.Add(mr.counters)
+	return counters
+}
+
+// taskFiles returns the files a task publishes
+func (mr *MapReduce) taskFiles(task Task) []string {
+	if task.Type == ReduceTask {
+		return []string{outputName(mr.outputDir, mr.outputPattern, task.ID)}
+	}
+	files := make([]string, mr.nReduce)
+	for r := range files {
+		files[r] = intermediateName(mr.workDir, task.ID, r)
+	}
+	return files
+}
 
-		// Sort keys for consistent output
-		var keys []string
-		for key := range keyGroups {
-			keys = append(keys, key)
+// finishTask records a completed task's counters and, if the job keeps a
+// journal, notes it there
+func (mr *MapReduce) finishTask(task Task, counters Counters, elapsed time.Duration) error {
+	if mr.journal != nil {
+		if err := mr.journal.record(task, mr.taskFiles(task), counters); err != nil {
+			return taskError(task, mr.journalPath(), err)
 		}
-		sort.Strings(keys)
+	}
+	mr.addCounters(task, counters)
+	mr.logf("%v task %d completed in %v", task.Type, task.ID, elapsed.Round(time.Microsecond))
+	return nil
+}
+
+// PrintTaskCounters writes the user counters of each completed task to w
+func (mr *MapReduce) PrintTaskCounters(w io.Writer) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	printTaskCounters(w, mr.taskCounters)
+}
 
-		// Run reduce function for each key and write output
-		outputFilename := fmt.Sprintf("mr-out-%d", r)
-		file, err := os.Create(outputFilename)
+// RunMapPhase executes the map phase
+// For each input split, it runs the map function and partitions the output.
+// It returns the errors of every failed task, each a *TaskError.
+func (mr *MapReduce) RunMapPhase(ctx context.Context) error {
+	fmt.Println("=== Starting Map Phase ===")
+
+	splits, err := mr.Splits()
+	if err != nil {
+		return err
+	}
+	err = runTasks(ctx, len(splits), mr.parallelism, func(i int) error {
+		task := mr.mapTask(i)
+		if mr.done[taskKey{task.Type, task.ID}] {
+			fmt.Printf("Skipping split %d: done by an earlier run\n", i)
+			return nil
+		}
+		fmt.Printf("Processing split %d: %s\n", i, splits[i])
+		start := time.Now()
+		counters, err := doMap(ctx, mr.app, task)
 		if err != nil {
-			log.Fatalf("Error creating output file %s: %v", outputFilename, err)
+			mr.logf("%v", err)
+			return err
 		}
+		return mr.finishTask(task, counters, time.Since(start))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("=== Map Phase Complete ===")
+	return nil
+}
 
-		for _, key := range keys {
-			values := keyGroups[key]
-			result := mr.reduceFunc(key, values)
-			fmt.Fprintf(file, "%v %v\n", key, result)
-		}
-		file.Close()
+// RunReducePhase executes the reduce phase
+// For each reduce task, it collects all intermediate files and runs the
+// reduce function. It returns the errors of every failed task, each a *TaskError.
+func (mr *MapReduce) RunReducePhase(ctx context.Context) error {
+	fmt.Println("=== Starting Reduce Phase ===")
 
-		fmt.Printf("  Created output file: %s (%d unique keys)\n", outputFilename, len(keys))
+	if _, err := mr.Splits(); err != nil {
+		return err
+	}
+	err := runTasks(ctx, mr.nReduce, mr.parallelism, func(r int) error {
+		task := mr.reduceTask(r)
+		if mr.done[taskKey{task.Type, task.ID}] {
+			fmt.Printf("Skipping reduce task %d: done by an earlier run\n", r)
+			return nil
+		}
+		fmt.Printf("Running reduce task %d\n", r)
+		start := time.Now()
+		counters, err := doReduce(ctx, mr.app, task)
+		if err != nil {
+			mr.logf("%v", err)
+			return err
+		}
+		return mr.finishTask(task, counters, time.Since(start))
+	})
+	if err != nil {
+		return err
 	}
 	fmt.Println("=== Reduce Phase Complete ===")
+	return nil
 }
 
-// Cleanup removes intermediate files
+// Cleanup removes the job's intermediate files, and its intermediate
+// directory if the job has a directory of its own
 func (mr *MapReduce) Cleanup() {
 	fmt.Println("=== Cleaning up intermediate files ===")
-	for m := 0; m < len(mr.inputFiles); m++ {
+	for m := 0; m < len(mr.splits); m++ {
 		for r := 0; r < mr.nReduce; r++ {
-			filename := fmt.Sprintf("mr-%d-%d", m, r)
+			filename := intermediateName(mr.workDir, m, r)
 			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
 				fmt.Printf("Warning: could not remove %s: %v\n", filename, err)
 			}
 		}
 	}
+	removeTempFiles(mr.workDir, mr.id)
+	mr.removeOutputTempFiles(mr.id)
+	if mr.jobDir != "" {
+		// Only succeeds once the directory is empty
+		os.Remove(mr.workDir)
+	}
+	if mr.journal != nil {
+		mr.journal.remove()
+		mr.journal = nil
+	}
+}
+
+// removeOutput deletes the output files of a job that did not finish, so
+// that a complete set of output files always means a successful job
+func (mr *MapReduce) removeOutput() {
+	for _, filename := range mr.OutputFiles() {
+		os.Remove(filename)
+	}
+}
+
+// removeOutputTempFiles deletes the temporary files that job jobID left
+// while writing the job's output files. The output directory may be shared
+// with other jobs, whose temporary files are left alone.
+func (mr *MapReduce) removeOutputTempFiles(jobID string) {
+	for _, filename := range mr.OutputFiles() {
+		removeTempFilesFor(filename, jobID)
+	}
 }
 
 // Run executes the complete MapReduce job
-func (mr *MapReduce) Run() {
+// If a task fails or ctx is cancelled, Run stops, removes the job's
+// intermediate and output files, and returns the error. While it runs, the
+// job's progress is kept in a journal in the work directory, so that if
+// the process dies Resume can carry on from where it stopped.
+func (mr *MapReduce) Run(ctx context.Context) error {
+	return mr.run(ctx, false)
+}
+
+// Resume finishes a job whose earlier run died, using the journal it left
+// in the work directory. The job must have the same inputs and number of
+// reduce tasks. Tasks the journal records as done are skipped if their
+// files are still there, and leftover files of unfinished tasks are removed.
+func (mr *MapReduce) Resume(ctx context.Context) error {
+	return mr.run(ctx, true)
+}
+
+func (mr *MapReduce) run(ctx context.Context, resume bool) error {
 	fmt.Println("🚀 Starting MapReduce Job")
+	fmt.Printf("Job ID: %s\n", mr.id)
+	if mr.jobDir != "" {
+		fmt.Printf("Job directory: %s\n", mr.jobDir)
+	}
 	fmt.Printf("Input files: %v\n", mr.inputFiles)
-	fmt.Printf("Number of reduce tasks: %d\n\n", mr.nReduce)
+	fmt.Printf("Number of reduce tasks: %d\n", mr.nReduce)
+	fmt.Printf("Parallelism: %d\n\n", mr.parallelism)
 
-	mr.RunMapPhase()
-	mr.RunReducePhase()
+	if err := checkApp(mr.app); err != nil {
+		return err
+	}
+	if err := checkNReduce(mr.nReduce); err != nil {
+		return err
+	}
+	if err := checkPartitioner(mr.partitioner, mr.nReduce); err != nil {
+		return err
+	}
+	if err := checkOutputPattern(mr.outputPattern); err != nil {
+		return err
+	}
+	if err := checkJobID(mr.id); err != nil {
+		return err
+	}
+	if _, err := mr.Splits(); err != nil {
+		return err
+	}
+	if err := mr.openLog(); err != nil {
+		return err
+	}
+	defer mr.closeLog()
+	mr.logf("job %s started: %d map tasks, %d reduce tasks, inputs %v", mr.id, len(mr.splits), mr.nReduce, mr.inputFiles)
+	if resume {
+		if err := mr.loadJournal(); err != nil {
+			return err
+		}
+		fmt.Printf("Resuming: %d of %d tasks already done\n\n", len(mr.done), len(mr.splits)+mr.nReduce)
+	} else if err := mr.startJournal(); err != nil {
+		return err
+	}
+
+	if err := mr.RunMapPhase(ctx); err != nil {
+		mr.Cleanup()
+		mr.logf("job failed in the map phase")
+		return fmt.Errorf("map phase failed: %w", err)
+	}
+	if err := mr.RunReducePhase(ctx); err != nil {
+		mr.Cleanup()
+		mr.removeOutput()
+		mr.logf("job failed in the reduce phase")
+		return fmt.Errorf("reduce phase failed: %w", err)
+	}
 	mr.Cleanup()
+	mr.logf("job complete: %d output records", mr.Counters()[ReduceOutputRecords])
 
 	fmt.Println("✅ MapReduce Job Complete!")
+	fmt.Println("Counters:")
+	mr.Counters().Print(os.Stdout)
+	mr.PrintTaskCounters(os.Stdout)
+	return nil
 }
@@ -0,0 +1,39 @@
+//go:build ignore
+
+// Word count as a plugin app, in the style of the 6.824 mrapps
+// Build it with: go build -buildmode=plugin -o wc.so mrapps/wc.go
+// and run it with: go run . run wc.so sample*.txt
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Map emits (word, "1") for each word in contents
+func Map(filename string, contents string, emit func(key, value string)) {
+	// A word is a run of letters
+	words := strings.FieldsFunc(contents, func(r rune) bool { return r > unicode.MaxASCII || !unicode.IsLetter(r) })
+	for _, word := range words {
+		emit(strings.ToLower(word), "1")
+	}
+}
+
+// Reduce adds up the counts for a word
+func Reduce(key string, values []string) string {
+	total := 0
+	for _, value := range values {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			count = 1
+		}
+		total += count
+	}
+	return strconv.Itoa(total)
+}
+
+// Combine sums counts inside a map task; a sum is safe to apply early
+func Combine(key string, values []string) string {
+	return Reduce(key, values)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// fetchAttempts is how many times a reduce task tries to fetch a partition
+// before giving up on the worker that holds it
+const fetchAttempts = 3
+
+// fetchClient downloads partitions from other workers
+var fetchClient = &http.Client{Timeout: time.Minute}
+
+// shuffleServer serves the intermediate files of the map tasks a worker
+// has run, so that reduce tasks on other machines can fetch them over HTTP
+// instead of reading them from a shared filesystem
+type shuffleServer struct {
+	mu     sync.Mutex
+	addr   string       // host:port that reduce tasks fetch from
+	tasks  map[int]Task // map tasks whose output is served, by ID
+	server *http.Server
+}
+
+// startShuffleServer starts serving map output on addr, such as ":0" for
+// any free port. With no host in addr, the server is advertised under the
+// machine's host name.
+func startShuffleServer(addr string) (*shuffleServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening for shuffle requests on %s: %w", addr, err)
+	}
+	s := &shuffleServer{addr: advertisedAddr(addr, l.Addr()), tasks: make(map[int]Task)}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(l)
+	return s, nil
+}
+
+// advertisedAddr returns the address other machines should use to reach
+// a listener bound to addr
+func advertisedAddr(addr string, bound net.Addr) string {
+	host, _, _ := net.SplitHostPort(addr)
+	_, port, _ := net.SplitHostPort(bound.String())
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if host, _ = os.Hostname(); host == "" {
+			host = "localhost"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// partitionPath is the URL path of partition r of map task m's output
+func partitionPath(m, r int) string {
+	return fmt.Sprintf("/partition/%d/%d", m, r)
+}
+
+// add starts serving the output of a completed map task
+func (s *shuffleServer) add(task Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.ID] = task
+}
+
+func (s *shuffleServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var m, r int
+	if _, err := fmt.Sscanf(req.URL.Path, "/partition/%d/%d", &m, &r); err != nil || req.URL.Path != partitionPath(m, r) {
+		http.NotFound(w, req)
+		return
+	}
+	s.mu.Lock()
+	task, ok := s.tasks[m]
+	s.mu.Unlock()
+	if !ok || r < 0 || r >= task.NReduce {
+		http.NotFound(w, req)
+		return
+	}
+	file, err := os.Open(intermediateName(task.WorkDir, m, r))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, req, "", time.Time{}, file)
+}
+
+// Close stops the server and removes the map output it was serving,
+// which no reduce task needs once the job is over
+func (s *shuffleServer) Close() {
+	s.server.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range s.tasks {
+		for r := 0; r < task.NReduce; r++ {
+			os.Remove(intermediateName(task.WorkDir, task.ID, r))
+		}
+		// Drop the work directory too, unless it still holds other files
+		os.Remove(task.WorkDir)
+	}
+}
+
+// FetchError reports that a reduce task could not fetch a map task's
+// output from the worker that ran it, which has most likely died. The map
+// task has to be run again before the reduce task can succeed.
+type FetchError struct {
+	Map  int    // map task whose output is lost
+	Addr string // shuffle address of the worker that ran it
+	Err  error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching output of map task %d from %s: %v", e.Map, e.Addr, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// fetchPartition downloads the reduce task's partition of map task m from
+// the worker that ran it into a temporary file in the task's work
+// directory, retrying with a growing pause, and returns the file's name and
+// size. It fails with a *FetchError once every attempt has.
+func fetchPartition(ctx context.Context, task Task, m int) (string, int64, error) {
+	addr := task.MapAddrs[m]
+	var err error
+	for i := 0; i < fetchAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(time.Duration(i) * 500 * time.Millisecond):
+			case <-ctx.Done():
+				return "", 0, ctx.Err()
+			}
+		}
+		var name string
+		var n int64
+		if name, n, err = fetchOnce(ctx, addr, m, task); err == nil {
+			return name, n, nil
+		}
+		if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+	}
+	return "", 0, &FetchError{Map: m, Addr: addr, Err: err}
+}
+
+// fetchOnce makes one attempt at downloading a partition
+func fetchOnce(ctx context.Context, addr string, m int, task Task) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+partitionPath(m, task.ID), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("server replied %s", resp.Status)
+	}
+
+	file, err := os.CreateTemp(task.WorkDir, fmt.Sprintf("%sfetch-%d-%d-*", jobTempPrefix(task.JobID), m, task.ID))
+	if err != nil {
+		return "", 0, fmt.Errorf("creating fetch file: %w", err)
+	}
+	n, err := io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	return file.Name(), n, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "strings"
+
+// NGramApp returns an app that counts each sequence of n consecutive words
+// With n = 1 it is word count.
+func NGramApp(n int) App {
+	return App{
+		Map:          NGramMap(n),
+		Reduce:       WordCountReduce,
+		StreamReduce: WordCountStreamReduce,
+		Combine:      WordCountReduce,
+	}
+}
+
+// NGramMap returns a map function emitting ("w1 w2 ... wn", "1") for each
+// run of n words in the input
+func NGramMap(n int) MapFunction {
+	return func(filename string, contents string) []KeyValue {
+		words := splitWords(contents)
+		var keyValues []KeyValue
+		for i := 0; i+n <= len(words); i++ {
+			keyValues = append(keyValues, KeyValue{Key: strings.Join(words[i:i+n], " "), Value: "1"})
+		}
+		return keyValues
+	}
+}
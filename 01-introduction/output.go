@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// OutputFormat selects how reduce tasks write their results
+type OutputFormat string
+
+const (
+	// OutputText writes "key value" lines, as the original implementation did
+	// It is easy to read but ambiguous when keys contain spaces.
+	OutputText OutputFormat = "text"
+	// OutputTSV writes "key<TAB>value" lines, escaping tabs, newlines and
+	// backslashes as \t, \n and \\
+	OutputTSV OutputFormat = "tsv"
+	// OutputCSV writes two-column RFC 4180 CSV rows
+	OutputCSV OutputFormat = "csv"
+	// OutputJSONL writes one {"key": ..., "value": ...} object per line
+	OutputJSONL OutputFormat = "jsonl"
+)
+
+// DefaultOutputPattern names reduce task r's output file mr-out-r
+const DefaultOutputPattern = "mr-out-%d"
+
+// parseOutputFormat checks an output format name from the command line
+func parseOutputFormat(name string) (OutputFormat, error) {
+	switch f := OutputFormat(name); f {
+	case OutputText, OutputTSV, OutputCSV, OutputJSONL:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (available: text, tsv, csv, jsonl)", name)
+}
+
+// checkOutputPattern makes sure an output file name pattern has exactly
+// one verb for the reduce task number and no directory part
+func checkOutputPattern(pattern string) error {
+	if strings.Count(pattern, "%") != 1 || strings.Contains(fmt.Sprintf(pattern, 0), "%!") {
+		return fmt.Errorf("output pattern %q must contain exactly one integer verb such as %%d or %%05d", pattern)
+	}
+	if strings.ContainsRune(pattern, filepath.Separator) {
+		return fmt.Errorf("output pattern %q must be a file name; use the output directory to choose where it goes", pattern)
+	}
+	return nil
+}
+
+// outputName returns the path of reduce task r's output file
+// An empty dir means the current directory and an empty pattern DefaultOutputPattern
+func outputName(dir, pattern string, r int) string {
+	if pattern == "" {
+		pattern = DefaultOutputPattern
+	}
+	return filepath.Join(dir, fmt.Sprintf(pattern, r))
+}
+
+// newOutputWriter returns a writer for reduce results in the given format
+// An empty format means text
+func newOutputWriter(f OutputFormat, w io.Writer) (recordWriter, error) {
+	bw := bufio.NewWriter(w)
+	switch f {
+	case OutputText, "":
+		return &textOutputWriter{w: bw, separator: " "}, nil
+	case OutputTSV:
+		return &textOutputWriter{w: bw, separator: "\t", escape: tsvEscaper}, nil
+	case OutputCSV:
+		return csvOutputWriter{csv.NewWriter(w)}, nil
+	case OutputJSONL:
+		return &jsonRecordWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", f)
+}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// textOutputWriter writes one "key<separator>value" line per result
+type textOutputWriter struct {
+	w         *bufio.Writer
+	separator string
+	escape    *strings.Replacer // nil writes keys and values unchanged
+}
+
+func (tw *textOutputWriter) Write(kv KeyValue) error {
+	key, value := kv.Key, kv.Value
+	if tw.escape != nil {
+		key, value = tw.escape.Replace(key), tw.escape.Replace(value)
+	}
+	_, err := fmt.Fprintf(tw.w, "%s%s%s\n", key, tw.separator, value)
+	return err
+}
+
+func (tw *textOutputWriter) Close() error {
+	return tw.w.Flush()
+}
+
+// csvOutputWriter writes one key,value row per result
+type csvOutputWriter struct {
+	w *csv.Writer
+}
+
+func (cw csvOutputWriter) Write(kv KeyValue) error {
+	return cw.w.Write([]string{kv.Key, kv.Value})
+}
+
+func (cw csvOutputWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultDamping is the probability that a random surfer follows a link
+// rather than jumping to a random page
+const DefaultDamping = 0.85
+
+// PageRankApp returns one iteration of PageRank over a link graph. Each
+// input line is either a page with its rank and links, "page<TAB>rank
+// link1 link2 ...", as the app itself writes with TSV output, or a page
+// and its links as a crawler lists them, "page link1 link2 ...", which
+// starts with rank 1. Ranks are not normalized: a page's rank is
+// (1 - damping) + damping × the sum of rank/outlinks over pages linking to
+// it, so ranks average 1 across a graph without dead ends.
+func PageRankApp(damping float64) App {
+	return App{
+		MapContext: PageRankMap,
+		Reduce:     PageRankReduce(damping),
+		Input:      LineInput{},
+	}
+}
+
+// parsePageRankLine splits a line of PageRank input into its page, rank and links
+func parsePageRankLine(line string) (page string, rank float64, links []string, err error) {
+	page, rest, ranked := strings.Cut(line, "\t")
+	if !ranked {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return "", 0, nil, fmt.Errorf("blank PageRank line")
+		}
+		return fields[0], 1, fields[1:], nil
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", 0, nil, fmt.Errorf("page %q has no rank", page)
+	}
+	rank, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("page %q: bad rank: %w", page, err)
+	}
+	return page, rank, fields[1:], nil
+}
+
+// PageRankMap passes on each page's links, tagged with "L", and gives an
+// equal share of its rank to every page it links to. Malformed lines are
+// skipped and counted in the malformed_lines counter.
+func PageRankMap(ctx *TaskContext, record Record) []KeyValue {
+	if strings.TrimSpace(record.Value) == "" {
+		return nil
+	}
+	page, rank, links, err := parsePageRankLine(record.Value)
+	if err != nil {
+		// Skip malformed lines rather than failing the whole job
+		ctx.Counter("malformed_lines").Inc()
+		return nil
+	}
+	keyValues := []KeyValue{{Key: page, Value: "L" + strings.Join(links, " ")}}
+	if len(links) == 0 {
+		return keyValues
+	}
+	share := strconv.FormatFloat(rank/float64(len(links)), 'g', -1, 64)
+	for _, link := range links {
+		keyValues = append(keyValues, KeyValue{Key: link, Value: share})
+	}
+	return keyValues
+}
+
+// PageRankReduce returns a reduce function that adds up the rank shares a
+// page received, returning its new rank followed by its links
+func PageRankReduce(damping float64) ReduceFunction {
+	return func(key string, values []string) string {
+		var sum float64
+		var links []string
+		for _, value := range values {
+			if strings.HasPrefix(value, "L") {
+				links = append(links, strings.Fields(value[1:])...)
+				continue
+			}
+			share, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			sum += share
+		}
+		rank := (1 - damping) + damping*sum
+		return strings.Join(append([]string{strconv.FormatFloat(rank, 'f', 6, 64)}, links...), " ")
+	}
+}
+
+// PageRankConverged returns a ConvergedFunc that stops once the ranks of
+// all pages together moved by less than epsilon in an iteration
+func PageRankConverged(epsilon float64) ConvergedFunc {
+	return func(iteration int, previous, current []string) (bool, error) {
+		before, err := readRanks(previous)
+		if err != nil {
+			return false, err
+		}
+		after, err := readRanks(current)
+		if err != nil {
+			return false, err
+		}
+		var delta float64
+		for page, rank := range after {
+			delta += math.Abs(rank - before[page])
+		}
+		fmt.Printf("Total rank change: %.6f\n", delta)
+		return delta < epsilon, nil
+	}
+}
+
+// readRanks returns the rank of each page in PageRank input or output files
+// Pages with no line of their own, which only receive links, have rank 0,
+// and malformed lines are skipped as PageRankMap skips them.
+func readRanks(files []string) (map[string]float64, error) {
+	ranks := make(map[string]float64)
+	err := readLines(files, func(line string) error {
+		if page, rank, _, err := parsePageRankLine(line); err == nil {
+			ranks[page] = rank
+		}
+		return nil
+	})
+	return ranks, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Partitioner decides which reduce task receives a key
+// Partition must return a number in [0, nReduce)
+type Partitioner interface {
+	Partition(key string, nReduce int) int
+}
+
+// HashPartitioner spreads keys over reduce tasks by their hash
+// It is the default, and balances well when nothing is known about the keys
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key string, nReduce int) int {
+	return ihash(key) % nReduce
+}
+
+// RangePartitioner sends keys to reduce tasks by comparing them with
+// sorted split points: reduce task i gets the keys k with
+// Splits[i-1] <= k < Splits[i]. Because every output file is sorted,
+// concatenating mr-out-0 .. mr-out-N gives globally sorted output.
+type RangePartitioner struct {
+	Splits []string // nReduce-1 split points in increasing order
+}
+
+// NewRangePartitioner creates a range partitioner, checking that the
+// split points are strictly increasing
+func NewRangePartitioner(splits []string) (RangePartitioner, error) {
+	for i := 1; i < len(splits); i++ {
+		if splits[i-1] >= splits[i] {
+			return RangePartitioner{}, fmt.Errorf("split points must be strictly increasing: %q >= %q", splits[i-1], splits[i])
+		}
+	}
+	return RangePartitioner{Splits: splits}, nil
+}
+
+func (p RangePartitioner) Partition(key string, nReduce int) int {
+	// Index of the first split point greater than the key
+	i := sort.Search(len(p.Splits), func(i int) bool { return p.Splits[i] > key })
+	if i >= nReduce {
+		i = nReduce - 1
+	}
+	return i
+}
+
+// PartitionerFunc adapts an ordinary function to the Partitioner interface
+// Functions cannot be sent to workers, so a custom partitioner for a
+// distributed job has to be part of the workers' App instead;
+// NewCoordinator rejects a job that uses one.
+type PartitionerFunc func(key string, nReduce int) int
+
+func (f PartitionerFunc) Partition(key string, nReduce int) int {
+	return f(key, nReduce)
+}
+
+func init() {
+	// Allow partitioners to travel inside a Task over RPC
+	gob.Register(HashPartitioner{})
+	gob.Register(RangePartitioner{})
+}
+
+// checkPartitioner reports whether p can be used with nReduce reduce tasks
+func checkPartitioner(p Partitioner, nReduce int) error {
+	if rp, ok := p.(RangePartitioner); ok && len(rp.Splits) != nReduce-1 {
+		return fmt.Errorf("range partitioner has %d split points, need %d for %d reduce tasks", len(rp.Splits), nReduce-1, nReduce)
+	}
+	return nil
+}
+
+// parsePartitioner builds a partitioner from its command-line description
+// kind is "hash" or "range"; splits is a comma-separated list of split points
+// An empty kind returns nil, leaving the choice to the application
+func parsePartitioner(kind, splits string) (Partitioner, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "hash":
+		return HashPartitioner{}, nil
+	case "range":
+		if splits == "" {
+			return nil, fmt.Errorf("range partitioner needs -splits")
+		}
+		return NewRangePartitioner(strings.Split(splits, ","))
+	}
+	return nil, fmt.Errorf("unknown partitioner %q (available: hash, range)", kind)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Stage is one MapReduce job in a pipeline
+type Stage struct {
+	Name      string
+	App       App
+	NReduce   int
+	Inputs    []string // input files read in addition to the outputs of DependsOn
+	DependsOn []string // stages whose output files become this stage's input
+	Options   []Option // job options; the output and work directories are set by the pipeline
+	Retries   int      // times a failed stage is run again before the pipeline gives up
+	Keep      bool     // keep the output even after every consumer has finished
+}
+
+// StageError reports a stage that failed on its last attempt
+type StageError struct {
+	Stage    string
+	Attempts int
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %s failed after %d attempts: %v", e.Stage, e.Attempts, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Pipeline runs MapReduce jobs whose inputs are the outputs of other jobs
+// Stages form a DAG: each one starts as soon as every stage it depends on
+// has finished, so independent stages run at the same time. A stage's
+// output goes to dir/<name>, and is removed once every stage reading it
+// has finished, unless the stage has no consumers or sets Keep.
+type Pipeline struct {
+	dir    string
+	stages []*Stage
+	byName map[string]*Stage
+
+	mu   sync.Mutex
+	done map[string][]string // output files of each finished stage
+}
+
+// NewPipeline creates an empty pipeline that keeps its data under dir
+func NewPipeline(dir string) *Pipeline {
+	return &Pipeline{
+		dir:    dir,
+		byName: make(map[string]*Stage),
+		done:   make(map[string][]string),
+	}
+}
+
+// Add appends a stage to the pipeline
+// A stage may only depend on stages added before it, which keeps the graph acyclic.
+func (p *Pipeline) Add(stage Stage) error {
+	if stage.Name == "" || stage.Name != filepath.Base(stage.Name) {
+		return fmt.Errorf("stage name %q must be a plain file name", stage.Name)
+	}
+	if _, ok := p.byName[stage.Name]; ok {
+		return fmt.Errorf("duplicate stage %q", stage.Name)
+	}
+	for _, dep := range stage.DependsOn {
+		if _, ok := p.byName[dep]; !ok {
+			return fmt.Errorf("stage %q depends on unknown stage %q", stage.Name, dep)
+		}
+	}
+	if len(stage.Inputs) == 0 && len(stage.DependsOn) == 0 {
+		return fmt.Errorf("stage %q has no inputs", stage.Name)
+	}
+	p.stages = append(p.stages, &stage)
+	p.byName[stage.Name] = &stage
+	return nil
+}
+
+// StageDir returns the directory holding a stage's output files
+func (p *Pipeline) StageDir(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// Outputs returns the output files of a finished stage
+func (p *Pipeline) Outputs(name string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done[name]
+}
+
+// Run executes every stage that has not finished yet
+// A stage whose dependency failed is skipped. Run returns a *StageError for
+// each stage that failed; running the pipeline again retries only those
+// stages and the ones they block.
+func (p *Pipeline) Run(ctx context.Context) error {
+	// finished[name] is closed when the stage ends, successfully or not
+	finished := make(map[string]chan struct{})
+	for _, stage := range p.stages {
+		finished[stage.Name] = make(chan struct{})
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, stage := range p.stages {
+		wg.Add(1)
+		go func(stage *Stage) {
+			defer wg.Done()
+			defer close(finished[stage.Name])
+
+			for _, dep := range stage.DependsOn {
+				<-finished[dep]
+			}
+			if _, ok := p.lookupDone(stage.Name); ok {
+				return // finished by an earlier run
+			}
+			var inputs []string
+			for _, dep := range stage.DependsOn {
+				files, ok := p.lookupDone(dep)
+				if !ok {
+					return // the dependency failed and reported its error
+				}
+				inputs = append(inputs, files...)
+			}
+			inputs = append(inputs, stage.Inputs...)
+
+			if err := p.runStage(ctx, stage, inputs); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			p.release(stage)
+		}(stage)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) lookupDone(name string) ([]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	files, ok := p.done[name]
+	return files, ok
+}
+
+// runStage runs one stage, retrying it if it fails
+func (p *Pipeline) runStage(ctx context.Context, stage *Stage, inputs []string) error {
+	dir := p.StageDir(stage.Name)
+	opts := append([]Option{}, stage.Options...)
+	opts = append(opts,
+		WithApp(stage.App),
+		WithJobDir(dir),
+		WithOutputDir(dir),
+		WithWorkDir(filepath.Join(dir, "work")),
+	)
+
+	var err error
+	attempts := 0
+	for attempts <= stage.Retries && ctx.Err() == nil {
+		attempts++
+		fmt.Printf("=== Stage %s (attempt %d) ===\n", stage.Name, attempts)
+		job := NewMapReduce(stage.App.Map, stage.App.Reduce, stage.NReduce, inputs, opts...)
+		if err = job.Run(ctx); err == nil {
+			p.mu.Lock()
+			p.done[stage.Name] = job.OutputFiles()
+			p.mu.Unlock()
+			return nil
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return &StageError{Stage: stage.Name, Attempts: attempts, Err: err}
+}
+
+// release removes the outputs of the stages that stage read from, once
+// every stage reading them has finished
+func (p *Pipeline) release(stage *Stage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, dep := range stage.DependsOn {
+		if p.byName[dep].Keep {
+			continue
+		}
+		consumed := true
+		for _, other := range p.stages {
+			if _, ok := p.done[other.Name]; !ok && dependsOn(other, dep) {
+				consumed = false
+				break
+			}
+		}
+		if consumed {
+			fmt.Printf("Removing output of stage %s\n", dep)
+			os.RemoveAll(p.StageDir(dep))
+		}
+	}
+}
+
+// dependsOn reports whether stage reads the output of the stage called name
+func dependsOn(stage *Stage, name string) bool {
+	for _, dep := range stage.DependsOn {
+		if dep == name {
+			return true
+		}
+	}
+	return false
+}
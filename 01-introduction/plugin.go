@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"reflect"
+)
+
+// Apps can be built separately as Go plugins and loaded by file name, for
+// example -app=wc.so. A plugin cannot import this package (it is package
+// main), so its functions use only built-in types:
+//
+//	func Map(filename string, contents string, emit func(key, value string))
+//	func Reduce(key string, values []string) string
+//	func Combine(key string, values []string) string // optional
+//
+// Build one with: go build -buildmode=plugin -o wc.so mrapps/wc.go
+type (
+	pluginMapFunc    = func(filename string, contents string, emit func(key, value string))
+	pluginReduceFunc = func(key string, values []string) string
+)
+
+// loadPlugin opens a plugin file and wraps its functions as an App
+func loadPlugin(path string) (App, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return App{}, fmt.Errorf("loading plugin %s: %w", path, err)
+	}
+
+	var mapf pluginMapFunc
+	if err := lookupSymbol(p, path, "Map", &mapf, true); err != nil {
+		return App{}, err
+	}
+	var reducef, combinef pluginReduceFunc
+	if err := lookupSymbol(p, path, "Reduce", &reducef, true); err != nil {
+		return App{}, err
+	}
+	if err := lookupSymbol(p, path, "Combine", &combinef, false); err != nil {
+		return App{}, err
+	}
+
+	app := App{
+		Map: func(filename string, contents string) []KeyValue {
+			var keyValues []KeyValue
+			mapf(filename, contents, func(key, value string) {
+				keyValues = append(keyValues, KeyValue{Key: key, Value: value})
+			})
+			return keyValues
+		},
+		Reduce: reducef,
+	}
+	if combinef != nil {
+		app.Combine = combinef
+	}
+	return app, nil
+}
+
+// lookupSymbol stores the plugin's function called name in fn, which must
+// point to a variable of the expected function type
+func lookupSymbol(p *plugin.Plugin, path, name string, fn any, required bool) error {
+	want := reflect.TypeOf(fn).Elem()
+	sym, err := p.Lookup(name)
+	if err != nil {
+		if required {
+			return fmt.Errorf("plugin %s does not export %s (want %v)", path, name, want)
+		}
+		return nil
+	}
+	got := reflect.ValueOf(sym)
+	if got.Type() != want {
+		return fmt.Errorf("plugin %s: %s has type %v, want %v", path, name, got.Type(), want)
+	}
+	reflect.ValueOf(fn).Elem().Set(got)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+)
+
+// TaskType identifies what a worker is being asked to do
+type TaskType int
+
+const (
+	MapTask    TaskType = iota // run the map function over one input split
+	ReduceTask                 // run the reduce function over one partition
+	WaitTask                   // nothing is available yet, ask again later
+	ExitTask                   // the job is finished, the worker should exit
+)
+
+func (t TaskType) String() string {
+	switch t {
+	case MapTask:
+		return "map"
+	case ReduceTask:
+		return "reduce"
+	case WaitTask:
+		return "wait"
+	case ExitTask:
+		return "exit"
+	}
+	return fmt.Sprintf("TaskType(%d)", int(t))
+}
+
+// Task describes one unit of work handed from the coordinator to a worker
+type Task struct {
+	Type    TaskType
+	ID      int    // map task number or reduce partition number
+	Attempt int    // incremented each time the task is handed out
+	Split   Split  // input of a map task
+	NMap    int    // total number of map tasks in the job
+	NReduce int    // total number of reduce tasks in the job
+	WorkDir string // directory of the job's intermediate files
+	JobID   string // starts the names of the task's temporary files
+
+	MemoryBudget int64       // bytes a reduce task may use to buffer its inputs
+	Partitioner  Partitioner // nil means the worker's own or the hash partitioner
+	InputFormat  InputFormat // nil means the worker's own or whole-file input
+	Encoding     Encoding    // format of intermediate files
+	Compression  Compression // codec for intermediate files
+
+	OutputFormat  OutputFormat // how a reduce task writes its results
+	OutputDir     string       // directory of the reduce task's output file
+	OutputPattern string       // output file name pattern, see outputName
+
+	// Shuffle address of the worker holding each map task's output, by
+	// map task number, for a reduce task to fetch it from; "" means the
+	// output is in WorkDir on a filesystem shared with that worker
+	MapAddrs []string
+}
+
+// RequestTaskArgs is sent by a worker that is ready for more work
+type RequestTaskArgs struct {
+	WorkerID string
+}
+
+// RequestTaskReply carries the task the worker should run next
+type RequestTaskReply struct {
+	Task Task
+}
+
+// ReportTaskArgs is sent by a worker when it has finished a task
+type ReportTaskArgs struct {
+	WorkerID string
+	Type     TaskType
+	ID       int
+	Attempt  int
+	Err      string   // empty if the task succeeded
+	Counters Counters // counts gathered while running the task
+
+	ShuffleAddr string // where a map task's output can be fetched; "" if it is not served
+	LostAddr    string // shuffle address a reduce task could not fetch map output from
+}
+
+// CommitTaskArgs is sent by a worker that has written a task's output and
+// wants to publish it
+type CommitTaskArgs struct {
+	WorkerID string
+	Type     TaskType
+	ID       int
+	Attempt  int
+}
+
+// CommitTaskReply says whether the worker may publish its output
+// Only one copy of a task is allowed to, so backup copies do not
+// overwrite each other.
+type CommitTaskReply struct {
+	OK bool
+}
+
+// ReportTaskReply is empty; the coordinator only acknowledges the report
+type ReportTaskReply struct{}
+
+// DefaultCoordinatorAddr is the Unix socket used when no address is given
+func DefaultCoordinatorAddr() string {
+	return fmt.Sprintf("unix:/var/tmp/mr-coordinator-%d", os.Getuid())
+}
+
+// splitAddr turns an address such as "unix:/tmp/mr.sock", "tcp:localhost:1234"
+// or "localhost:1234" into a network and address for net.Dial / net.Listen
+func splitAddr(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "tcp:"):
+		return "tcp", strings.TrimPrefix(addr, "tcp:")
+	case strings.Contains(addr, "/"):
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// listen opens a listener on addr, removing a stale Unix socket first
+func listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		os.Remove(address)
+	}
+	return net.Listen(network, address)
+}
+
+// call sends an RPC request to the coordinator and waits for the response
+func call(addr string, rpcname string, args interface{}, reply interface{}) error {
+	network, address := splitAddr(addr)
+	client, err := rpc.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Call(rpcname, args, reply)
+}
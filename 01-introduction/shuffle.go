@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultMemoryBudget is how much memory a reduce task may use for
+// buffering its inputs while merging them
+const DefaultMemoryBudget = 64 << 20 // 64MB
+
+// readBufferSize is the buffer kept for each intermediate file being merged
+const readBufferSize = 64 << 10 // 64KB
+
+// gzipReaderSize is roughly what a gzip reader holds: flate's 32KB window
+// and its Huffman tables
+const gzipReaderSize = 48 << 10
+
+// readerCost is the memory one intermediate file takes while it is merged:
+// its read buffer, the block its records are decoded from, and the buffers
+// of its decompressor. A record larger than a block takes more.
+func readerCost(encoding Encoding, compression Compression) int64 {
+	cost := int64(readBufferSize)
+	if encoding == EncodingBinary {
+		cost += binaryBlockSize
+	}
+	switch compression {
+	case CompressLZ:
+		cost += 2 * lzBlockSize // the compressed block and the decompressed one
+	case CompressGzip:
+		cost += gzipReaderSize
+	}
+	return cost
+}
+
+// recordReader yields the records of an intermediate file in order
+// Read returns io.EOF once there are no more records
+type recordReader interface {
+	Read() (KeyValue, error)
+}
+
+// namedReader adds the file name to errors from a recordReader
+type namedReader struct {
+	name string
+	recordReader
+}
+
+func (r namedReader) Read() (KeyValue, error) {
+	kv, err := r.recordReader.Read()
+	if err != nil && err != io.EOF {
+		return kv, fmt.Errorf("%s: %w", r.name, err)
+	}
+	return kv, err
+}
+
+// openRuns opens each sorted intermediate file for merging
+// The returned function closes all of them
+func openRuns(names []string, encoding Encoding) ([]recordReader, func(), error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+
+	readers := make([]recordReader, 0, len(names))
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("opening intermediate file %s: %w", name, err)
+		}
+		files = append(files, file)
+		reader, err := newIntermediateReader(bufio.NewReaderSize(file, readBufferSize), encoding)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		readers = append(readers, namedReader{name: name, recordReader: reader})
+	}
+	return readers, closeAll, nil
+}
+
+// mergeSource is the next unread record of one input to the merge
+type mergeSource struct {
+	kv     KeyValue
+	index  int // position of the input, used to break ties between equal keys
+	reader recordReader
+}
+
+// mergeHeap orders merge sources by key, then by input position, so values
+// for the same key come out in the order of the inputs
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key {
+		return h[i].kv.Key < h[j].kv.Key
+	}
+	return h[i].index < h[j].index
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	source := old[n-1]
+	*h = old[:n-1]
+	return source
+}
+
+// mergeIterator performs a k-way merge of inputs that are each sorted by key
+type mergeIterator struct {
+	h   mergeHeap
+	err error
+}
+
+func newMergeIterator(readers []recordReader) *mergeIterator {
+	m := &mergeIterator{}
+	for i, reader := range readers {
+		m.advance(&mergeSource{index: i, reader: reader})
+	}
+	return m
+}
+
+// advance reads the next record from source and puts it back on the heap
+func (m *mergeIterator) advance(source *mergeSource) {
+	kv, err := source.reader.Read()
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		m.err = err
+		return
+	}
+	source.kv = kv
+	heap.Push(&m.h, source)
+}
+
+// Next returns the smallest remaining record across all inputs
+func (m *mergeIterator) Next() (KeyValue, bool) {
+	if m.err != nil || len(m.h) == 0 {
+		return KeyValue{}, false
+	}
+	source := heap.Pop(&m.h).(*mergeSource)
+	kv := source.kv
+	m.advance(source)
+	return kv, true
+}
+
+// Err returns the first error met while reading the inputs
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+// groupIterator splits a merged, sorted stream of records into one group per key
+type groupIterator struct {
+	merge   *mergeIterator
+	next    KeyValue
+	hasNext bool
+	key     string // key of the current group
+	started bool   // whether NextKey has been called
+	records int64  // number of records read so far
+}
+
+func newGroupIterator(merge *mergeIterator) *groupIterator {
+	g := &groupIterator{merge: merge}
+	g.advance()
+	return g
+}
+
+func (g *groupIterator) advance() {
+	g.next, g.hasNext = g.merge.Next()
+	if g.hasNext {
+		g.records++
+	}
+}
+
+// NextKey moves to the next key, skipping any values of the current key
+// that the reduce function did not consume
+func (g *groupIterator) NextKey() (string, *ValueIterator, bool) {
+	for g.started && g.hasNext && g.next.Key == g.key {
+		g.advance()
+	}
+	g.started = true
+	if !g.hasNext {
+		return "", nil, false
+	}
+	g.key = g.next.Key
+	return g.key, &ValueIterator{group: g, key: g.key}, true
+}
+
+// ValueIterator streams the values for one key to a reduce function
+// without holding them all in memory
+type ValueIterator struct {
+	group *groupIterator
+	key   string
+}
+
+// Next returns the next value for the key, or false when there are no more
+func (it *ValueIterator) Next() (string, bool) {
+	g := it.group
+	if !g.hasNext || g.next.Key != it.key {
+		return "", false
+	}
+	value := g.next.Value
+	g.advance()
+	return value, true
+}
+
+// spillPattern is the pattern for temporary runs written while merging
+// the reduce task's inputs. Each gets a unique name, so two attempts at the
+// same reduce task cannot trip over each other's spill files.
+func spillPattern(task Task) string {
+	return fmt.Sprintf("%sspill-%d-*", jobTempPrefix(task.JobID), task.ID)
+}
+
+// mergeInto merges the sorted runs in names into a new spill file for the
+// reduce task and returns its name
+func mergeInto(task Task, names []string) (string, error) {
+	readers, closeAll, err := openRuns(names, task.Encoding)
+	if err != nil {
+		return "", err
+	}
+	defer closeAll()
+
+	// Spill next to the runs being merged
+	file, err := os.CreateTemp(filepath.Dir(names[0]), spillPattern(task))
+	if err != nil {
+		return "", fmt.Errorf("creating spill file: %w", err)
+	}
+	defer file.Close()
+	name := file.Name()
+
+	w, err := newIntermediateWriter(file, task.Encoding, task.Compression)
+	if err != nil {
+		return name, err
+	}
+	merge := newMergeIterator(readers)
+	for kv, ok := merge.Next(); ok; kv, ok = merge.Next() {
+		if err := w.Write(kv); err != nil {
+			return name, fmt.Errorf("writing spill file %s: %w", name, err)
+		}
+	}
+	if err := merge.Err(); err != nil {
+		return name, err
+	}
+	if err := w.Close(); err != nil {
+		return name, fmt.Errorf("writing spill file %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// shrinkRuns merges neighbouring runs into spill files on disk, one pass
+// at a time, until no more than fanIn remain to be merged in memory.
+// Keeping neighbours together preserves the order of values for each key.
+// It returns the remaining runs and every spill file it created.
+func shrinkRuns(ctx context.Context, task Task, runs []string, fanIn int) ([]string, []string, error) {
+	var spills []string
+	for len(runs) > fanIn {
+		var merged []string
+		for i := 0; i < len(runs); i += fanIn {
+			end := i + fanIn
+			if end > len(runs) {
+				end = len(runs)
+			}
+			if end-i == 1 {
+				merged = append(merged, runs[i])
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, spills, err
+			}
+			name, err := mergeInto(task, runs[i:end])
+			if name != "" {
+				spills = append(spills, name)
+			}
+			if err != nil {
+				return nil, spills, err
+			}
+			merged = append(merged, name)
+		}
+		runs = merged
+	}
+	return runs, spills, nil
+}
+
+// mergeFanIn returns how many runs of the task can be merged at once
+// within its memory budget
+func mergeFanIn(task Task) int {
+	fanIn := int(task.MemoryBudget / readerCost(task.Encoding, task.Compression))
+	if fanIn < 2 {
+		fanIn = 2
+	}
+	return fanIn
+}
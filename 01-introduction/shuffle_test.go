@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestMergeFanIn(t *testing.T) {
+	plain := mergeFanIn(Task{MemoryBudget: DefaultMemoryBudget, Encoding: EncodingJSON, Compression: CompressNone})
+	if want := DefaultMemoryBudget / readBufferSize; plain != want {
+		t.Errorf("fan-in for plain JSON is %d; want %d", plain, want)
+	}
+	// Block and decompression buffers count against the budget too
+	lz := mergeFanIn(Task{MemoryBudget: DefaultMemoryBudget, Encoding: EncodingBinary, Compression: CompressLZ})
+	if want := DefaultMemoryBudget / (readBufferSize + binaryBlockSize + 2*lzBlockSize); lz != want {
+		t.Errorf("fan-in for binary lz is %d; want %d", lz, want)
+	}
+	if got := mergeFanIn(Task{MemoryBudget: 1}); got != 2 {
+		t.Errorf("fan-in with a tiny budget is %d; want 2", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// FileChunk is a byte range of an input file
+type FileChunk struct {
+	File   string
+	Offset int64
+	Length int64
+	Whole  bool // the chunk is the entire file
+}
+
+func (c FileChunk) String() string {
+	if c.Whole {
+		return c.File
+	}
+	return fmt.Sprintf("%s[%d:%d]", c.File, c.Offset, c.Offset+c.Length)
+}
+
+// Split is the input of one map task: a piece of a large file, or
+// several small files combined
+type Split struct {
+	ID     int
+	Chunks []FileChunk
+}
+
+func (s Split) String() string {
+	names := make([]string, len(s.Chunks))
+	for i, chunk := range s.Chunks {
+		names[i] = chunk.String()
+	}
+	return strings.Join(names, " + ")
+}
+
+// Size returns the number of input bytes in the split
+func (s Split) Size() int64 {
+	var size int64
+	for _, chunk := range s.Chunks {
+		size += chunk.Length
+	}
+	return size
+}
+
+// nextLineStart returns the offset of the first byte after the first
+// newline at or after offset, or the file size if there is none
+func nextLineStart(file *os.File, offset, size int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for offset < size {
+		n, err := file.ReadAt(buf, offset)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return offset + int64(i) + 1, nil
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// chunkFile cuts a file into chunks of about splitSize bytes, moving each
+// cut forward to the start of the next line so no record is broken in two
+func chunkFile(filename string, size, splitSize int64) ([]FileChunk, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var chunks []FileChunk
+	for start := int64(0); start < size; {
+		end := size
+		if start+splitSize < size {
+			// The line containing the cut belongs to this chunk
+			if end, err = nextLineStart(file, start+splitSize-1, size); err != nil {
+				return nil, err
+			}
+		}
+		chunks = append(chunks, FileChunk{File: filename, Offset: start, Length: end - start})
+		start = end
+	}
+	return chunks, nil
+}
+
+// ComputeSplits divides the input files into map task inputs of about
+// splitSize bytes. Files larger than splitSize are cut on line boundaries;
+// files smaller than it are combined, in order, until a split is full.
+// A splitSize of 0 gives one split per file. Splits are numbered in input
+// order, so the same inputs always produce the same split IDs.
+func ComputeSplits(inputFiles []string, splitSize int64) ([]Split, error) {
+	var splits []Split
+	add := func(chunks ...FileChunk) {
+		splits = append(splits, Split{ID: len(splits), Chunks: chunks})
+	}
+
+	var pending []FileChunk // small files waiting to be combined
+	var pendingSize int64
+	flush := func() {
+		if len(pending) > 0 {
+			add(pending...)
+			pending, pendingSize = nil, 0
+		}
+	}
+
+	for _, filename := range inputFiles {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		size := info.Size()
+		whole := FileChunk{File: filename, Length: size, Whole: true}
+
+		switch {
+		case splitSize <= 0:
+			add(whole)
+		case size >= splitSize:
+			chunks, err := chunkFile(filename, size, splitSize)
+			if err != nil {
+				return nil, err
+			}
+			if len(chunks) == 1 {
+				add(whole)
+				continue
+			}
+			for _, chunk := range chunks {
+				add(chunk)
+			}
+		default:
+			pending = append(pending, whole)
+			pendingSize += size
+			if pendingSize >= splitSize {
+				flush()
+			}
+		}
+	}
+	flush()
+	return splits, nil
+}
+
+// openChunk returns a buffered reader over the bytes of an input chunk
+// The returned function closes the underlying file
+func openChunk(chunk FileChunk) (*bufio.Reader, func(), error) {
+	file, err := os.Open(chunk.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = file
+	if !chunk.Whole {
+		r = io.NewSectionReader(file, chunk.Offset, chunk.Length)
+	}
+	return bufio.NewReaderSize(r, 64<<10), func() { file.Close() }, nil
+}
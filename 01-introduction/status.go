@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (s taskState) String() string {
+	switch s {
+	case taskIdle:
+		return "idle"
+	case taskInProgress:
+		return "in-progress"
+	case taskCompleted:
+		return "completed"
+	}
+	return fmt.Sprintf("taskState(%d)", int(s))
+}
+
+// JobStatus is a snapshot of a distributed job's progress, as served by
+// the coordinator's status page
+type JobStatus struct {
+	ID       string        `json:"id"`
+	Phase    string        `json:"phase"` // map, reduce or done
+	Elapsed  float64       `json:"elapsed_seconds"`
+	Phases   []PhaseStatus `json:"phases"`
+	Counters Counters      `json:"counters"` // totals over all completed tasks
+}
+
+// PhaseStatus counts the tasks of one phase in each state and lists them
+type PhaseStatus struct {
+	Type       string       `json:"type"`
+	Total      int          `json:"total"`
+	Idle       int          `json:"idle"`
+	InProgress int          `json:"in_progress"`
+	Completed  int          `json:"completed"`
+	Tasks      []TaskStatus `json:"tasks"`
+}
+
+// TaskStatus describes one task. Duration is the run time of the copy
+// that completed the task, or how long the oldest running copy has been
+// going; Retries counts the copies handed out after the first, whether
+// after a failure, a timeout, a backup or lost map output.
+type TaskStatus struct {
+	ID       int      `json:"id"`
+	State    string   `json:"state"`
+	Input    string   `json:"input,omitempty"`   // split read by a map task
+	Workers  []string `json:"workers,omitempty"` // workers running the task, or the one that completed it
+	Duration float64  `json:"duration_seconds"`
+	Retries  int      `json:"retries"`
+	Backup   bool     `json:"backup,omitempty"` // a backup copy was launched
+	Counters Counters `json:"counters,omitempty"`
+}
+
+// Status returns a snapshot of the job's progress
+func (c *Coordinator) Status() JobStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := JobStatus{
+		ID:       c.job.id,
+		Phase:    "done",
+		Counters: make(Counters),
+	}
+	switch {
+	case c.mapsLeft > 0:
+		status.Phase = MapTask.String()
+	case c.reducesLeft > 0:
+		status.Phase = ReduceTask.String()
+	}
+	end := time.Now()
+	if !c.finished.IsZero() {
+		end = c.finished
+	}
+	status.Elapsed = end.Sub(c.started).Seconds()
+	status.Counters.Add(c.counters)
+
+	for _, tasks := range []struct {
+		Type  TaskType
+		Infos []taskInfo
+	}{{MapTask, c.mapTasks}, {ReduceTask, c.reduceTasks}} {
+		phase := PhaseStatus{Type: tasks.Type.String(), Total: len(tasks.Infos), Tasks: []TaskStatus{}}
+		for i := range tasks.Infos {
+			info := &tasks.Infos[i]
+			switch info.state {
+			case taskIdle:
+				phase.Idle++
+			case taskInProgress:
+				phase.InProgress++
+			case taskCompleted:
+				phase.Completed++
+			}
+			phase.Tasks = append(phase.Tasks, taskStatus(info))
+		}
+		status.Phases = append(status.Phases, phase)
+	}
+	return status
+}
+
+// taskStatus describes one task for the status page
+func taskStatus(info *taskInfo) TaskStatus {
+	task := TaskStatus{
+		ID:       info.task.ID,
+		State:    info.state.String(),
+		Backup:   info.backup != 0,
+		Counters: info.counters,
+	}
+	if info.task.Type == MapTask {
+		task.Input = info.task.Split.String()
+	}
+	if info.task.Attempt > 1 {
+		task.Retries = info.task.Attempt - 1
+	}
+	switch info.state {
+	case taskInProgress:
+		var oldest time.Time
+		for _, a := range info.running {
+			task.Workers = append(task.Workers, a.worker)
+			if oldest.IsZero() || a.startTime.Before(oldest) {
+				oldest = a.startTime
+			}
+		}
+		sort.Strings(task.Workers)
+		task.Duration = time.Since(oldest).Seconds()
+	case taskCompleted:
+		task.Workers = []string{info.worker}
+		task.Duration = info.duration.Seconds()
+	}
+	return task
+}
+
+// ServeStatus starts serving the job's progress over HTTP on addr in the
+// background: a page for people at / and the same data as JSON at
+// /status.json. It returns the address it listens on, which tells the
+// port chosen when addr is ":0".
+func (c *Coordinator) ServeStatus(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("listening for status requests on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", c.serveStatusPage)
+	mux.HandleFunc("/status.json", c.serveStatusJSON)
+	go http.Serve(l, mux)
+	return l.Addr().String(), nil
+}
+
+func (c *Coordinator) serveStatusJSON(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.Status())
+}
+
+func (c *Coordinator) serveStatusPage(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPage.Execute(w, c.Status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// formatCounters lists counters as "name=value" pairs in name order
+func formatCounters(counters Counters) string {
+	var pairs []string
+	for name, n := range counters {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, n))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// statusPage shows a JobStatus, reloading itself every two seconds
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"counters": formatCounters,
+	"seconds": func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+	},
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if ne .Phase "done"}}<meta http-equiv="refresh" content="2">{{end}}
+<title>MapReduce job {{.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; font-size: 90%; }
+.idle { color: #888; }
+.in-progress { background: #fff6d5; }
+.completed { background: #e5f6e5; }
+</style>
+</head>
+<body>
+<h1>MapReduce job {{.ID}}</h1>
+<p>Phase: <b>{{.Phase}}</b> &middot; elapsed {{seconds .Elapsed}} &middot; <a href="/status.json">JSON</a></p>
+{{range .Phases}}
+<h2>{{.Type}} tasks: {{.Completed}}/{{.Total}} completed, {{.InProgress}} in progress, {{.Idle}} idle</h2>
+<table>
+<tr><th>Task</th><th>State</th><th>Input</th><th>Workers</th><th>Duration</th><th>Retries</th><th>Counters</th></tr>
+{{range .Tasks}}<tr class="{{.State}}"><td>{{.ID}}</td><td>{{.State}}{{if .Backup}} (backup){{end}}</td><td>{{.Input}}</td><td>{{join .Workers ", "}}</td><td>{{if ne .State "idle"}}{{seconds .Duration}}{{end}}</td><td>{{.Retries}}</td><td>{{counters .Counters}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Counters</h2>
+<table>
+{{range $name, $n := .Counters}}<tr><td>{{$name}}</td><td>{{$n}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Streaming runs external programs as the mapper and reducer, in the style
+// of Hadoop Streaming. Each command is run with sh -c, once per input chunk
+// for the mapper and once per reduce task for the reducer.
+//
+// The mapper reads input records on stdin, one per line (whole-file input
+// passes the file's contents unchanged), and prints key<TAB>value lines.
+// The reducer reads the same kind of lines sorted by key, so all values for
+// a key arrive together, and prints key<TAB>value result lines. A line
+// without a tab is a key with an empty value.
+//
+// The mapper can find its input file in the MR_INPUT_FILE environment variable.
+
+// StreamingApp returns an app that runs the mapper and reducer commands
+func StreamingApp(mapper, reducer string) App {
+	return App{
+		MapChunk:        StreamingMapper(mapper),
+		ReducePartition: StreamingReducer(reducer),
+	}
+}
+
+// StreamingMapper returns a map function that pipes each input chunk's
+// records through command
+func StreamingMapper(command string) ChunkMapFunction {
+	return func(ctx context.Context, chunk FileChunk, records RecordReader) ([]KeyValue, error) {
+		var keyValues []KeyValue
+		feed := func(w io.Writer) error {
+			for {
+				record, err := records.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := writeLine(w, record.Value); err != nil {
+					return err
+				}
+			}
+		}
+		collect := func(kv KeyValue) error {
+			keyValues = append(keyValues, kv)
+			return nil
+		}
+		env := []string{"MR_INPUT_FILE=" + chunk.File}
+		if err := runStreaming(ctx, "mapper", command, env, feed, collect); err != nil {
+			return nil, err
+		}
+		return keyValues, nil
+	}
+}
+
+// StreamingReducer returns a reduce function that pipes a reduce task's
+// sorted records through command
+func StreamingReducer(command string) PartitionReduceFunction {
+	return func(ctx context.Context, next func() (KeyValue, bool), emit func(KeyValue) error) error {
+		feed := func(w io.Writer) error {
+			for kv, ok := next(); ok; kv, ok = next() {
+				if err := writeLine(w, kv.Key+"\t"+kv.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return runStreaming(ctx, "reducer", command, nil, feed, emit)
+	}
+}
+
+// writeLine writes s followed by a newline, unless it already ends with one
+func writeLine(w io.Writer, s string) error {
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// parseStreamingLine splits an output line into a key and a value at the first tab
+func parseStreamingLine(line string) KeyValue {
+	key, value, _ := strings.Cut(line, "\t")
+	return KeyValue{Key: key, Value: value}
+}
+
+// runStreaming runs command, writing its input with feed while passing
+// each line it prints to emit. The command's stderr goes to ours.
+func runStreaming(ctx context.Context, role, command string, env []string, feed func(io.Writer) error, emit func(KeyValue) error) error {
+	// Stop the command if anything on our side fails
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(runCtx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting %s %q: %w", role, command, err)
+	}
+
+	feedErr := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriter(stdin)
+		err := feed(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		stdin.Close()
+		if err != nil && !errors.Is(err, syscall.EPIPE) {
+			cancel()
+		}
+		feedErr <- err
+	}()
+
+	var emitErr error
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" && emitErr == nil {
+			if emitErr = emit(parseStreamingLine(strings.TrimSuffix(line, "\n"))); emitErr != nil {
+				cancel()
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	// A command that exits without reading all of its input breaks the pipe
+	inputErr := <-feedErr
+	waitErr := cmd.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case emitErr != nil:
+		return emitErr
+	case inputErr != nil && !errors.Is(inputErr, syscall.EPIPE):
+		return inputErr
+	case waitErr != nil:
+		return fmt.Errorf("%s %q: %w", role, command, waitErr)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// sortKeyLength is the length of the key at the start of each sort record
+// As in TeraSort, the rest of the line is the record's value
+const sortKeyLength = 10
+
+// Sampling parameters used to choose split points for the sort job
+const (
+	sampleChunks    = 10       // chunks read from each input file
+	sampleChunkSize = 64 << 10 // bytes per chunk
+	sampleSize      = 10000    // keys kept for computing split points
+)
+
+// SortMap emits one record per input line, keyed by its first sortKeyLength bytes
+func SortMap(filename string, contents string) []KeyValue {
+	var keyValues []KeyValue
+	for _, line := range strings.Split(contents, "\n") {
+		if line == "" {
+			continue
+		}
+		key, value := line, ""
+		if len(line) > sortKeyLength {
+			key, value = line[:sortKeyLength], strings.TrimLeft(line[sortKeyLength:], " ")
+		}
+		keyValues = append(keyValues, KeyValue{Key: key, Value: value})
+	}
+	return keyValues
+}
+
+// SortReduce writes every record back out unchanged
+// A reduce function returns a single value per key, so records that share
+// a key are joined into one result holding one "key value" line each.
+func SortReduce(key string, values []string) string {
+	return strings.Join(values, "\n"+key+" ")
+}
+
+// readSampleChunk reads up to sampleChunkSize bytes of file starting at
+// offset, trimmed to whole lines
+func readSampleChunk(file *os.File, offset int64) (string, error) {
+	buf := make([]byte, sampleChunkSize)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	chunk := string(buf[:n])
+
+	// Drop the partial line at each end of the chunk
+	if offset > 0 {
+		if i := strings.IndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[i+1:]
+		} else {
+			return "", nil
+		}
+	}
+	if err != io.EOF {
+		if i := strings.LastIndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[:i+1]
+		}
+	}
+	return chunk, nil
+}
+
+// sampleKeys runs mapf over evenly spaced chunks of every input file and
+// returns the keys it emits, sorted
+func sampleKeys(mapf MapFunction, inputFiles []string) ([]string, error) {
+	var keys []string
+	for _, filename := range inputFiles {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("sampling %s: %w", filename, err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("sampling %s: %w", filename, err)
+		}
+
+		// Small files are sampled whole, large ones in evenly spaced chunks
+		var chunks []string
+		if info.Size() <= sampleChunks*sampleChunkSize {
+			content, err := io.ReadAll(file)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("sampling %s: %w", filename, err)
+			}
+			chunks = append(chunks, string(content))
+		} else {
+			for i := int64(0); i < sampleChunks; i++ {
+				chunk, err := readSampleChunk(file, info.Size()*i/sampleChunks)
+				if err != nil {
+					file.Close()
+					return nil, fmt.Errorf("sampling %s: %w", filename, err)
+				}
+				chunks = append(chunks, chunk)
+			}
+		}
+		for _, chunk := range chunks {
+			for _, kv := range mapf(filename, chunk) {
+				keys = append(keys, kv.Key)
+			}
+		}
+		file.Close()
+	}
+
+	// Keep a uniform subset so sorting stays cheap
+	if len(keys) > sampleSize {
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		keys = keys[:sampleSize]
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SampleSplits chooses split points that divide the keys mapf emits for
+// inputFiles into nReduce partitions of roughly equal size. Fewer than
+// nReduce-1 split points are returned if the sample has too few distinct keys.
+func SampleSplits(mapf MapFunction, inputFiles []string, nReduce int) ([]string, error) {
+	keys, err := sampleKeys(mapf, inputFiles)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("sampling found no keys in %v", inputFiles)
+	}
+
+	var splits []string
+	for i := 1; i < nReduce; i++ {
+		split := keys[i*len(keys)/nReduce]
+		// Split points must be strictly increasing
+		if len(splits) == 0 || split > splits[len(splits)-1] {
+			splits = append(splits, split)
+		}
+	}
+	return splits, nil
+}
+
+// GenerateSortInput writes the given number of random records to filename, in
+// the same layout as TeraGen: a random printable key and a payload
+func GenerateSortInput(filename string, records int) error {
+	const keyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	key := make([]byte, sortKeyLength)
+	for i := 0; i < records; i++ {
+		for j := range key {
+			key[j] = keyChars[rand.Intn(len(keyChars))]
+		}
+		fmt.Fprintf(w, "%s %032X %s\n", key, i, strings.Repeat(string(rune('A'+i%26)), 48))
+	}
+	return w.Flush()
+}
+
+// ValidateSortOutput checks that the text output files read in order are
+// globally sorted, and returns the number of records in each
+func ValidateSortOutput(filenames []string) ([]int, error) {
+	counts := make([]int, len(filenames))
+	var previous string
+	for r, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			key := scanner.Text()
+			if len(key) > sortKeyLength {
+				key = key[:sortKeyLength]
+			}
+			if key < previous {
+				file.Close()
+				return nil, fmt.Errorf("%s: key %q follows %q", filename, key, previous)
+			}
+			previous = key
+			counts[r]++
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
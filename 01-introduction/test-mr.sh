@@ -0,0 +1,488 @@
+#!/bin/bash
+
+#
+# MapReduce tests, in the style of the 6.824 test-mr.sh
+# Runs each distributed job and compares its output with a sequential run
+#
+
+cd "$(dirname "$0")"
+
+echo "=== Building mr ==="
+go build -o mr . || exit 1
+
+TIMEOUT=3s
+failed=0
+
+# Run everything in a scratch directory so the mr-* files do not collide
+# Each job's output is in mr-jobs/<job-id>/output, so tests name their jobs
+rm -rf mr-tmp
+mkdir mr-tmp || exit 1
+cd mr-tmp || exit 1
+cp ../sample*.txt ../testdata/*.tsv .
+SOCK="unix:$(pwd)/mr.sock"
+
+# Reference output from the sequential implementation
+../mr -app=wc -job-id=reference sample*.txt > /dev/null || exit 1
+sort mr-jobs/reference/output/mr-out-* > mr-correct-wc.txt
+rm -rf mr-jobs/reference
+
+# check compares the output of the job named $1 with the sequential reference
+check() {
+    if sort mr-jobs/$1/output/mr-out-* 2> /dev/null | cmp - mr-correct-wc.txt > /dev/null; then
+        echo "--- $1 test: PASS"
+    else
+        echo "--- $1 test: FAIL (output differs from sequential run)"
+        failed=1
+    fi
+    rm -rf mr-jobs/$1
+}
+
+echo "=== parallel test: in-process task pool ==="
+../mr -job-id=parallel -app=wc -parallel=4 sample*.txt > /dev/null
+check parallel
+
+echo "=== binary test: checksummed binary intermediate files ==="
+../mr -job-id=binary -app=wc -encoding=binary -parallel=2 sample*.txt > /dev/null
+check binary
+
+echo "=== compress test: compressed intermediate files ==="
+../mr -job-id=compress-lz -app=wc -compress=lz sample*.txt > /dev/null
+check compress-lz
+../mr -job-id=compress-gzip -app=wc -encoding=binary -compress=gzip sample*.txt > /dev/null
+check compress-gzip
+
+echo "=== corrupt test: a damaged intermediate file fails the job ==="
+# The vanish app kills the job once the map phase is done; the intermediate
+# file is then damaged, and resuming the job has to report it
+for setup in "binary none flip" "binary lz flip" "binary gzip truncate" "json none truncate"; do
+    set -- $setup
+    MR_VANISH=1 ../mr -app=vanish -encoding=$1 -compress=$2 -work-dir=corrupt-jobs -job-id=$1-$2 sample*.txt > /dev/null 2>&1
+    file=corrupt-jobs/$1-$2/intermediate/mr-0-0
+    if [ "$3" = flip ]; then
+        printf 'X' | dd of=$file bs=1 seek=20 conv=notrunc 2> /dev/null
+    else
+        truncate -s 30 $file
+    fi
+    if ../mr resume corrupt-jobs/$1-$2 > corrupt.log 2>&1; then
+        echo "--- corrupt-$1-$2 test: FAIL (job read a damaged file without an error)"
+        failed=1
+    elif ! grep -q "corrupt intermediate data" corrupt.log || grep -q "missing header" corrupt.log; then
+        echo "--- corrupt-$1-$2 test: FAIL (damage not reported as corrupt data)"
+        failed=1
+    else
+        echo "--- corrupt-$1-$2 test: PASS"
+    fi
+done
+rm -rf corrupt-jobs
+
+echo "=== bench test: encodings and codecs compared ==="
+if [ "$(../mr -mode=bench -app=wc sample*.txt | grep -cE '^(json|binary) ')" = 4 ]; then
+    echo "--- bench test: PASS"
+else
+    echo "--- bench test: FAIL (missing results)"
+    failed=1
+fi
+
+echo "=== typed test: generic job with typed values ==="
+../mr -job-id=typed -app=wc-typed -split-size=100 sample*.txt > /dev/null
+check typed
+# Sorting samples keys with a plain Map, which typed jobs do not have
+if ../mr -mode=sort -app=wc-typed sample*.txt 2>&1 | grep -q "has no Map function"; then
+    echo "--- typed-sort test: PASS"
+else
+    echo "--- typed-sort test: FAIL (sorting a typed job not rejected)"
+    failed=1
+fi
+
+echo "=== split test: byte-size input splits ==="
+../mr -job-id=split-large -app=wc -split-size=100 sample*.txt > /dev/null
+check split-large
+../mr -job-id=split-combined -app=wc -split-size=100000 sample*.txt > /dev/null
+check split-combined
+
+echo "=== input test: record-oriented input formats ==="
+../mr -job-id=input-lines -app=wc -input=lines -split-size=100 sample*.txt > /dev/null
+check input-lines
+for f in sample*.txt; do tr ' ' '\t' < $f > ${f%.txt}.tsv; done
+../mr -job-id=input-tsv -app=wc -input=tsv sample*.tsv > /dev/null
+check input-tsv
+# Wrapping each line in a JSON array adds no letters, so the counts are unchanged
+for f in sample*.txt; do sed 's/.*/["&"]/' $f > ${f%.txt}.jsonl; done
+../mr -job-id=input-jsonl -app=wc -input=jsonl sample*.jsonl > /dev/null
+check input-jsonl
+echo 'not json' >> sample1.jsonl
+if ../mr -app=wc -job-id=input-bad-jsonl -input=jsonl sample*.jsonl > /dev/null 2>&1; then
+    echo "--- input-bad-jsonl test: FAIL (invalid JSON line was accepted)"
+    failed=1
+else
+    echo "--- input-bad-jsonl test: PASS"
+fi
+rm -rf mr-jobs/input-bad-jsonl sample*.tsv sample*.jsonl
+
+echo "=== output test: output formats, directory and file names ==="
+# Word count keys hold only letters, so each format converts back to "key value" lines
+../mr -app=wc -output-format=tsv -output-dir=out -output-pattern=part-%05d.tsv sample*.txt > /dev/null
+if [ -f out/part-00000.tsv ] && [ -f out/part-00002.tsv ] && cat out/part-*.tsv | tr '\t' ' ' | sort | cmp - mr-correct-wc.txt > /dev/null; then
+    echo "--- output-tsv test: PASS"
+else
+    echo "--- output-tsv test: FAIL (missing files or output differs from sequential run)"
+    failed=1
+fi
+rm -rf out
+../mr -job-id=output-csv -app=wc -output-format=csv sample*.txt > /dev/null
+sed -i 's/,/ /' mr-jobs/output-csv/output/mr-out-*
+check output-csv
+../mr -job-id=output-jsonl -app=wc -output-format=jsonl sample*.txt > /dev/null
+sed -i 's/^{"key":"\(.*\)","value":"\(.*\)"}$/\1 \2/' mr-jobs/output-jsonl/output/mr-out-*
+check output-jsonl
+
+echo "=== plugin test: apps loaded from Go plugins ==="
+go build -buildmode=plugin -o wc.so ../mrapps/wc.go || exit 1
+../mr run wc.so -job-id=plugin-run -parallel=2 sample*.txt > /dev/null
+check plugin-run
+# Flags after the plugin name count as much as those before it
+../mr run wc.so -work-dir=jobs -job-id=plugin sample*.txt > /dev/null
+if sort jobs/plugin/output/mr-out-* 2> /dev/null | cmp - mr-correct-wc.txt > /dev/null; then
+    echo "--- plugin-flags test: PASS"
+else
+    echo "--- plugin-flags test: FAIL (-job-id after the plugin name ignored)"
+    failed=1
+fi
+rm -rf jobs
+cat > bad.go << 'EOF'
+package main
+
+func Map(filename string, contents string) []string { return nil }
+EOF
+go build -buildmode=plugin -o bad.so bad.go || exit 1
+if ../mr run bad.so -job-id=plugin-bad sample*.txt 2>&1 | grep -q "Map has type"; then
+    echo "--- plugin-bad test: PASS"
+else
+    echo "--- plugin-bad test: FAIL (mistyped Map not reported)"
+    failed=1
+fi
+rm -rf mr-jobs/plugin-bad bad.go bad.so
+
+echo "=== streaming test: shell commands as mapper and reducer ==="
+MAPPER="tr -cs 'A-Za-z' '\\n' | tr 'A-Z' 'a-z' | grep . | sed 's/$/\t1/'"
+REDUCER="awk -F'\t' '{ n[\$1] += \$2 } END { for (w in n) print w \"\t\" n[w] }'"
+../mr -job-id=streaming -mapper="$MAPPER" -reducer="$REDUCER" -split-size=100 sample*.txt > /dev/null
+check streaming
+if ../mr -job-id=streaming-fail -mapper="exit 3" -reducer=cat sample*.txt 2>&1 | grep -q 'mapper "exit 3": exit status 3'; then
+    echo "--- streaming-fail test: PASS"
+else
+    echo "--- streaming-fail test: FAIL (failed mapper not reported)"
+    failed=1
+fi
+rm -rf mr-jobs/streaming-fail
+
+echo "=== apps test: standard apps against golden output ==="
+# golden compares the output of the job named $1 with testdata/golden/$1.txt
+golden() {
+    if sort mr-jobs/$1/output/mr-out-* 2> /dev/null | cmp - ../testdata/golden/$1.txt > /dev/null; then
+        echo "--- app-$1 test: PASS"
+    else
+        echo "--- app-$1 test: FAIL (output differs from testdata/golden/$1.txt)"
+        failed=1
+    fi
+    rm -rf mr-jobs/$1
+}
+# Small splits make the reducers merge partial results for each file
+../mr -app=index -job-id=index -split-size=100 -parallel=2 sample*.txt > /dev/null
+golden index
+../mr -app=grep -job-id=grep -pattern='(?i)map|reduce' -split-size=100 sample*.txt > /dev/null
+golden grep
+../mr -app=ngram -job-id=ngram -n=2 sample*.txt > /dev/null
+golden ngram
+../mr -app=tfidf -job-id=tfidf -split-size=100 sample*.txt > /dev/null
+golden tfidf
+../mr -app=join -job-id=join users.tsv orders.tsv > /dev/null
+golden join
+../mr -app=distinct -job-id=distinct -split-size=40 visits.tsv > /dev/null
+golden distinct
+
+echo "=== pipeline test: count and index run side by side, then are joined ==="
+../mr -mode=pipeline -job-id=pipeline -parallel=2 sample*.txt > pipeline.log
+# Each word's count, a tab, then the index entry
+cut -d' ' -f2- ../testdata/golden/index.txt | paste -d'\t' mr-correct-wc.txt - | sort > mr-pipeline-expected.txt
+if [ -d mr-jobs/pipeline/count ] || [ -d mr-jobs/pipeline/index ]; then
+    echo "--- pipeline test: FAIL (consumed stage output was not removed)"
+    failed=1
+elif sort mr-jobs/pipeline/join/mr-out-* | cmp - mr-pipeline-expected.txt > /dev/null; then
+    echo "--- pipeline test: PASS"
+else
+    echo "--- pipeline test: FAIL (joined output is wrong)"
+    failed=1
+fi
+rm -rf mr-jobs/pipeline
+
+echo "=== iterative test: PageRank and k-means rerun jobs on their own output ==="
+cp ../testdata/links.txt ../testdata/points.txt .
+# A fixed number of PageRank iterations, with split inputs
+../mr -mode=pagerank -job-id=pagerank -iterations=10 -epsilon=0 -split-size=40 -parallel=3 links.txt > /dev/null
+if [ "$(ls mr-jobs/pagerank)" != "iter-10" ]; then
+    echo "--- pagerank test: FAIL (earlier iterations were not removed)"
+    failed=1
+elif sort mr-jobs/pagerank/iter-10/mr-out-* | cmp - ../testdata/golden/pagerank.txt > /dev/null; then
+    echo "--- pagerank test: PASS"
+else
+    echo "--- pagerank test: FAIL (output differs from testdata/golden/pagerank.txt)"
+    failed=1
+fi
+# k-means stops as soon as the centroids settle
+../mr -mode=kmeans -job-id=kmeans -k=3 -iterations=20 -split-size=30 points.txt > kmeans.log
+if ! grep -q "Converged after" kmeans.log; then
+    echo "--- kmeans test: FAIL (did not converge)"
+    failed=1
+elif sort mr-jobs/kmeans/iter-*/mr-out-* | cmp - ../testdata/golden/kmeans.txt > /dev/null; then
+    echo "--- kmeans test: PASS"
+else
+    echo "--- kmeans test: FAIL (output differs from testdata/golden/kmeans.txt)"
+    failed=1
+fi
+rm -rf mr-jobs/pagerank mr-jobs/kmeans
+
+echo "=== jobs test: jobs with their own directories run side by side ==="
+../mr -app=wc -work-dir=jobs -job-id=wc -split-size=100 -parallel=2 sample*.txt > jobs-wc.log &
+../mr -app=index -work-dir=jobs -job-id=index -split-size=100 -parallel=2 sample*.txt > jobs-index.log
+wait
+if ls mr-[0-9]* mr-out-* > /dev/null 2>&1 || [ -e jobs/wc/intermediate ] || [ -e jobs/index/intermediate ]; then
+    echo "--- jobs test: FAIL (intermediate files left behind or written outside the job directory)"
+    failed=1
+elif ! grep -q "job complete" jobs/wc/logs/job.log; then
+    echo "--- jobs test: FAIL (job log missing)"
+    failed=1
+elif sort jobs/wc/output/mr-out-* | cmp - mr-correct-wc.txt > /dev/null &&
+    sort jobs/index/output/mr-out-* | cmp - ../testdata/golden/index.txt > /dev/null; then
+    echo "--- jobs test: PASS"
+else
+    echo "--- jobs test: FAIL (output differs from the expected output)"
+    failed=1
+fi
+rm -rf jobs
+# With no flags at all, jobs still keep their own files apart
+../mr -app=wc -split-size=100 -parallel=2 sample*.txt > shared-wc.log &
+../mr -app=index -split-size=100 -parallel=2 sample*.txt > shared-index.log
+wait
+WC_ID=$(sed -n 's/^Job ID: //p' shared-wc.log)
+INDEX_ID=$(sed -n 's/^Job ID: //p' shared-index.log)
+if ls mr-out-* > /dev/null 2>&1; then
+    echo "--- jobs-shared test: FAIL (output written outside the job directory)"
+    failed=1
+elif sort mr-jobs/$WC_ID/output/mr-out-* | cmp - mr-correct-wc.txt > /dev/null &&
+    sort mr-jobs/$INDEX_ID/output/mr-out-* | cmp - ../testdata/golden/index.txt > /dev/null; then
+    echo "--- jobs-shared test: PASS"
+else
+    echo "--- jobs-shared test: FAIL (jobs in the same directory disturbed each other)"
+    failed=1
+fi
+rm -rf mr-jobs/$WC_ID mr-jobs/$INDEX_ID
+
+echo "=== spill test: reduce merges in several passes ==="
+# A tiny memory budget forces reduce tasks to merge two files at a time
+../mr -app=wc -job-id=spill -memory=1 -encoding=binary -compress=lz sample*.txt sample*.txt sample*.txt > /dev/null
+sort mr-jobs/spill/output/mr-out-* | awk '{ print $1, $2 / 3 }' > mr-spill-wc.txt
+rm -rf mr-jobs/spill
+if cmp mr-spill-wc.txt mr-correct-wc.txt > /dev/null; then
+    echo "--- spill test: PASS"
+else
+    echo "--- spill test: FAIL (output differs from sequential run)"
+    failed=1
+fi
+
+echo "=== range test: range partitioning gives globally sorted output ==="
+../mr -app=wc -job-id=range -partitioner=range -splits=f,p sample*.txt > /dev/null
+(cd mr-jobs/range/output && cat mr-out-0 mr-out-1 mr-out-2) > mr-range-wc.txt
+if sort -c mr-range-wc.txt 2> /dev/null && sort mr-range-wc.txt | cmp - mr-correct-wc.txt > /dev/null; then
+    echo "--- range test: PASS"
+else
+    echo "--- range test: FAIL (output not globally sorted or differs from sequential run)"
+    failed=1
+fi
+rm -rf mr-jobs/range
+
+echo "=== sort test: sampled total-order sort ==="
+../mr -mode=gen -records=5000 sort-in-0 sort-in-1 > /dev/null
+if ../mr -mode=sort -job-id=sort -nreduce=4 sort-in-* > sort.log &&
+    cat sort-in-* | sort | cmp - <(cd mr-jobs/sort/output && cat mr-out-0 mr-out-1 mr-out-2 mr-out-3) > /dev/null; then
+    echo "--- sort test: PASS"
+else
+    echo "--- sort test: FAIL (output not globally sorted or records lost)"
+    failed=1
+fi
+rm -rf mr-jobs/sort sort-in-*
+
+echo "=== wc test: several workers share a job ==="
+../mr -job-id=wc -mode=coordinator -addr="$SOCK" -timeout=$TIMEOUT -split-size=100 sample*.txt > coordinator.log &
+COORD_PID=$!
+sleep 1
+../mr -mode=worker -app=wc.so -addr="$SOCK" > worker1.log &
+../mr -mode=worker -app=wc.so -addr="$SOCK" > worker2.log &
+../mr -mode=worker -app=wc.so -addr="$SOCK" > worker3.log &
+wait $COORD_PID
+wait
+check wc
+
+echo "=== backup test: a straggling map task gets a backup copy ==="
+../mr -job-id=backup -mode=coordinator -addr="$SOCK" -timeout=30s -split-size=100 -status-addr=localhost:0 sample*.txt > coordinator.log &
+COORD_PID=$!
+sleep 1
+# The first worker takes a map task and takes far longer than the others
+MR_STRAGGLER=1 ../mr -mode=worker -app=straggle -addr="$SOCK" > straggler.log &
+sleep 0.3
+../mr -mode=worker -app=straggle -addr="$SOCK" > worker1.log &
+../mr -mode=worker -app=straggle -addr="$SOCK" > worker2.log &
+# Look at the status page while the straggler holds up the map phase
+sleep 0.5
+STATUS_URL=$(grep -o "http://[^ ]*" coordinator.log)
+curl -s "${STATUS_URL}status.json" > status.json
+curl -s "$STATUS_URL" > status.html
+wait $COORD_PID
+wait
+if ! grep -Eq "backup_tasks_won +1$" coordinator.log; then
+    echo "--- backup test: FAIL (backup task did not win)"
+    failed=1
+elif grep -q "Created intermediate file" straggler.log; then
+    echo "--- backup test: FAIL (straggler published its output)"
+    failed=1
+elif ls -d mr-tmp-* mr-jobs/backup/intermediate > /dev/null 2>&1; then
+    echo "--- backup test: FAIL (files left behind)"
+    failed=1
+fi
+check backup
+
+echo "=== status test: the coordinator serves its progress over HTTP ==="
+if grep -q '"phase": "map"' status.json && grep -q '"state": "in-progress"' status.json &&
+    grep -q '"state": "completed"' status.json && grep -q "<h2>map tasks" status.html; then
+    echo "--- status test: PASS"
+else
+    echo "--- status test: FAIL (status page does not show the running job)"
+    failed=1
+fi
+
+echo "=== network test: reduce tasks fetch map output over HTTP ==="
+# Each worker keeps its intermediate files in a directory of its own, as
+# on a machine without a shared filesystem
+mkdir w1 w2 w3
+../mr -job-id=network -mode=coordinator -addr="$SOCK" -timeout=2s -split-size=100 -output-dir="$(pwd)/mr-jobs/network/output" "$(pwd)"/sample*.txt > coordinator.log 2>&1 &
+COORD_PID=$!
+sleep 1
+# The first worker runs every map task alone, then dies in its first
+# reduce task, taking the map output with it
+(cd w1 && MR_VANISH=1 ../../mr -mode=worker -app=vanish -addr="$SOCK" -shuffle-addr=localhost:0 > ../vanish.log 2>&1)
+(cd w2 && ../../mr -mode=worker -app=vanish -addr="$SOCK" -shuffle-addr=localhost:0 > ../worker1.log 2>&1) &
+(cd w3 && ../../mr -mode=worker -app=vanish -addr="$SOCK" -shuffle-addr=localhost:0 > ../worker2.log 2>&1) &
+wait $COORD_PID
+wait
+if ! grep -q "is lost, re-running it" coordinator.log; then
+    echo "--- network test: FAIL (lost map output was not re-run)"
+    failed=1
+elif ! grep -Eq "shuffle_fetched_bytes +[1-9]" coordinator.log; then
+    echo "--- network test: FAIL (no map output was fetched)"
+    failed=1
+elif [ -n "$(find w2 w3 -type f)" ]; then
+    echo "--- network test: FAIL (files left behind)"
+    failed=1
+fi
+check network
+rm -rf w1 w2 w3
+
+echo "=== counters test: user counters are summed per task and per job ==="
+printf 'home about\nabout\tnot-a-rank\nblog\tnot-a-rank\n' > links-bad.txt
+../mr -app=pagerank -job-id=counters -split-size=12 links-bad.txt > counters.log
+if grep -Eq "user.malformed_lines +2$" counters.log && [ "$(grep -c "task .*: malformed_lines=1$" counters.log)" = 2 ]; then
+    echo "--- counters test: PASS"
+else
+    echo "--- counters test: FAIL (malformed_lines not counted)"
+    failed=1
+fi
+rm -rf mr-jobs/counters
+
+echo "=== cancel test: an interrupted job removes its partial files ==="
+../mr -mode=gen -records=1000000 cancel-in > /dev/null
+../mr -app=wc -job-id=cancel -split-size=10000000 cancel-in > cancel.log 2>&1 &
+JOB_PID=$!
+sleep 1
+kill -INT $JOB_PID
+if wait $JOB_PID; then
+    echo "--- cancel test: FAIL (job finished before it could be cancelled)"
+    failed=1
+elif ls -d mr-jobs/cancel/output/* mr-jobs/cancel/intermediate mr-jobs/cancel/mr-journal > /dev/null 2>&1; then
+    echo "--- cancel test: FAIL (files left behind)"
+    failed=1
+elif ! grep -q "context canceled" cancel.log; then
+    echo "--- cancel test: FAIL (error does not report the cancellation)"
+    failed=1
+else
+    echo "--- cancel test: PASS"
+fi
+rm -rf mr-jobs/cancel cancel-in
+
+echo "=== resume test: a killed job carries on from its journal ==="
+../mr -mode=gen -records=100000 resume-in-0 resume-in-1 > /dev/null
+../mr -app=wc -job-id=resume-expected -split-size=1000000 resume-in-* > /dev/null
+sort mr-jobs/resume-expected/output/mr-out-* > mr-resume-expected.txt
+rm -rf mr-jobs/resume-expected
+../mr -app=wc -job-id=resume -split-size=1000000 resume-in-* > resume.log 2>&1 &
+JOB_PID=$!
+sleep 1.5
+# The journal of a running job is locked, so it cannot be resumed twice,
+# and resuming the latest job passes it over
+../mr resume mr-jobs/resume > resume-busy.log 2>&1
+BUSY=$?
+../mr resume > resume-latest.log 2>&1
+LATEST=$?
+kill -KILL $JOB_PID
+wait $JOB_PID 2> /dev/null
+if [ ! -f mr-jobs/resume/mr-journal ]; then
+    echo "--- resume test: FAIL (job finished before it could be killed)"
+    failed=1
+elif [ $BUSY = 0 ] || ! grep -q "in use by a running job" resume-busy.log; then
+    echo "--- resume test: FAIL (resumed a job that was still running)"
+    failed=1
+elif [ $LATEST = 0 ] || ! grep -q "no unfinished job" resume-latest.log; then
+    echo "--- resume test: FAIL (took a running job for the latest unfinished one)"
+    failed=1
+elif ! ../mr resume > resume.log 2>&1 || ! grep -q "Skipping split" resume.log; then
+    echo "--- resume test: FAIL (resume did not skip finished tasks)"
+    failed=1
+elif ls -d mr-jobs/resume/intermediate mr-jobs/resume/mr-journal > /dev/null 2>&1; then
+    echo "--- resume test: FAIL (files left behind)"
+    failed=1
+elif sort mr-jobs/resume/output/mr-out-* | cmp - mr-resume-expected.txt > /dev/null; then
+    echo "--- resume test: PASS"
+else
+    echo "--- resume test: FAIL (output differs from an uninterrupted run)"
+    failed=1
+fi
+rm -rf mr-jobs/resume resume-in-*
+
+echo "=== crash test: workers die or stall at random ==="
+# A short timeout makes stalled workers finish after their task was re-executed
+../mr -job-id=crash -mode=coordinator -addr="$SOCK" -timeout=1s sample*.txt > coordinator.log &
+COORD_PID=$!
+sleep 1
+# Keep restarting workers until the coordinator exits
+for i in 1 2 3; do
+    ( while kill -0 $COORD_PID 2> /dev/null; do
+        ../mr -mode=worker -app=crash -addr="$SOCK" > /dev/null 2>&1
+        sleep 0.2
+    done ) &
+done
+wait $COORD_PID
+wait
+if [ -n "$(find . -name 'mr-tmp-*')" ]; then
+    echo "--- crash test: FAIL (temporary files left behind)"
+    failed=1
+fi
+check crash
+
+cd ..
+rm -rf mr-tmp mr
+
+if [ $failed -eq 0 ]; then
+    echo "*** PASSED ALL TESTS"
+else
+    echo "*** FAILED SOME TESTS"
+    exit 1
+fi
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TFIDFApp returns an app that scores how characteristic each word is of
+// each of numDocs input files. A word's score in a file is its count there
+// (term frequency) times log(numDocs / number of files containing it)
+// (inverse document frequency), so words found in every file score 0.
+func TFIDFApp(numDocs int) App {
+	return App{
+		Map:    TFIDFMap,
+		Reduce: TFIDFReduce(numDocs),
+	}
+}
+
+// TFIDFMap emits (word, "filename count") for each distinct word in the file
+func TFIDFMap(filename string, contents string) []KeyValue {
+	counts := make(map[string]int)
+	for _, word := range splitWords(contents) {
+		counts[word]++
+	}
+	keyValues := make([]KeyValue, 0, len(counts))
+	for word, count := range counts {
+		keyValues = append(keyValues, KeyValue{Key: word, Value: fmt.Sprintf("%s %d", filename, count)})
+	}
+	return keyValues
+}
+
+// TFIDFReduce returns a reduce function that lists a word's score in each
+// file containing it, as "file=score" pairs in file order
+func TFIDFReduce(numDocs int) ReduceFunction {
+	return func(key string, values []string) string {
+		// A file split into several map tasks reports partial counts
+		counts := make(map[string]int)
+		for _, value := range values {
+			i := strings.LastIndexByte(value, ' ')
+			count, err := strconv.Atoi(value[i+1:])
+			if i < 0 || err != nil {
+				continue
+			}
+			counts[value[:i]] += count
+		}
+		files := make([]string, 0, len(counts))
+		for file := range counts {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+
+		idf := math.Log(float64(numDocs) / float64(len(files)))
+		scores := make([]string, len(files))
+		for i, file := range files {
+			scores[i] = fmt.Sprintf("%s=%.4f", file, float64(counts[file])*idf)
+		}
+		return strings.Join(scores, " ")
+	}
+}
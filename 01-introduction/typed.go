@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Pair is a key and value emitted by the map function of a typed Job
+type Pair[K, V any] struct {
+	Key   K `json:"key"`
+	Value V `json:"value"`
+}
+
+// Serializer converts values of type T to and from the strings that carry
+// them through the shuffle and into the output files. Keys are grouped and
+// sorted by their encoded form, so a key serializer must always encode
+// equal keys the same way. Encoded strings must be valid UTF-8 unless the
+// job uses binary intermediate files.
+type Serializer[T any] interface {
+	Encode(value T) (string, error)
+	Decode(s string) (T, error)
+}
+
+// StringSerializer passes strings through unchanged
+type StringSerializer struct{}
+
+func (StringSerializer) Encode(value string) (string, error) { return value, nil }
+func (StringSerializer) Decode(s string) (string, error)     { return s, nil }
+
+// Integer is the set of signed integer types IntSerializer handles
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+// IntSerializer writes integers in decimal
+type IntSerializer[T Integer] struct{}
+
+func (IntSerializer[T]) Encode(value T) (string, error) {
+	return strconv.FormatInt(int64(value), 10), nil
+}
+
+func (IntSerializer[T]) Decode(s string) (T, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if int64(T(n)) != n {
+		return 0, fmt.Errorf("%s is out of range for %T", s, T(0))
+	}
+	return T(n), nil
+}
+
+// FloatSerializer writes floats in the shortest form that reads back exactly
+type FloatSerializer struct{}
+
+func (FloatSerializer) Encode(value float64) (string, error) {
+	return strconv.FormatFloat(value, 'g', -1, 64), nil
+}
+
+func (FloatSerializer) Decode(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// JSONSerializer writes values, such as structs, as JSON
+type JSONSerializer[T any] struct{}
+
+func (JSONSerializer[T]) Encode(value T) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func (JSONSerializer[T]) Decode(s string) (T, error) {
+	var value T
+	err := json.Unmarshal([]byte(s), &value)
+	return value, err
+}
+
+// Job is a MapReduce application over typed keys and values: the map
+// function emits keys of type K with values of type V, and the reduce
+// function turns each key's values into a result of type R. Serializers
+// carry them through the framework's string-based shuffle, so map and
+// reduce functions never parse or format values themselves, and a value
+// that does not decode fails the task instead of being guessed at.
+// Results are written to the output files as the encoded key and result,
+// in the order of the encoded keys.
+//
+// The string API is a thin wrapper over Job: an App's map, combine and
+// reduce functions run as a Job[string, string, string] with
+// StringSerializer, and KeyValue is its Pair. Only ChunkMapFunction,
+// StreamReduceFunction and PartitionReduceFunction, which handle a whole
+// chunk, key or partition themselves, bypass it.
+type Job[K, V, R any] struct {
+	Map     func(record Record) []Pair[K, V]
+	Reduce  func(key K, values []V) R
+	Combine func(key K, values []V) V // optional; runs on each input chunk's values before they are encoded
+
+	Keys    Serializer[K]
+	Values  Serializer[V]
+	Results Serializer[R]
+
+	Input InputFormat // optional, as for App
+}
+
+// App returns the job as an App for the framework, to run with WithApp,
+// register in apps, or export from a plugin
+func (j Job[K, V, R]) App() App {
+	return App{
+		MapChunk:        j.mapChunk,
+		ReducePartition: j.reducePartition,
+		Input:           j.Input,
+	}
+}
+
+// NewJob creates a MapReduce job that runs the typed job j, as
+// NewMapReduce does for string map and reduce functions
+func NewJob[K, V, R any](j Job[K, V, R], nReduce int, inputFiles []string, opts ...Option) *MapReduce {
+	return NewMapReduce(nil, nil, nReduce, inputFiles, append([]Option{WithApp(j.App())}, opts...)...)
+}
+
+// mapChunk runs the map function over a chunk's records, combines each
+// key's values if the job has a combiner, and encodes the result. The
+// combiner's input and output are counted in the task's built-in counters.
+func (j Job[K, V, R]) mapChunk(ctx context.Context, chunk FileChunk, records RecordReader) ([]KeyValue, error) {
+	var keys []string
+	typedKeys := make(map[string]K)
+	values := make(map[string][]V)
+	var keyValues []KeyValue
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for _, pair := range j.Map(record) {
+			key, err := j.Keys.Encode(pair.Key)
+			if err != nil {
+				return nil, fmt.Errorf("encoding key %v: %w", pair.Key, err)
+			}
+			if j.Combine == nil {
+				value, err := j.Values.Encode(pair.Value)
+				if err != nil {
+					return nil, fmt.Errorf("key %q: encoding value %v: %w", key, pair.Value, err)
+				}
+				keyValues = append(keyValues, KeyValue{Key: key, Value: value})
+				continue
+			}
+			// Hold on to the typed values so the combiner needs no decoding
+			if _, ok := values[key]; !ok {
+				keys = append(keys, key)
+				typedKeys[key] = pair.Key
+			}
+			values[key] = append(values[key], pair.Value)
+		}
+	}
+
+	var combineInput int64
+	for _, key := range keys {
+		combineInput += int64(len(values[key]))
+		value, err := j.Values.Encode(j.Combine(typedKeys[key], values[key]))
+		if err != nil {
+			return nil, fmt.Errorf("key %q: encoding combined value: %w", key, err)
+		}
+		keyValues = append(keyValues, KeyValue{Key: key, Value: value})
+	}
+	if j.Combine != nil {
+		builtinCounter(ctx, CombineInputRecords).Add(combineInput)
+		builtinCounter(ctx, CombineOutputRecords).Add(int64(len(keys)))
+	}
+	return keyValues, nil
+}
+
+// reducePartition decodes each key of the partition with its values, in
+// key order, runs the reduce function on them and encodes the result
+func (j Job[K, V, R]) reducePartition(ctx context.Context, next func() (KeyValue, bool), emit func(KeyValue) error) error {
+	kv, ok := next()
+	for ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, err := j.Keys.Decode(kv.Key)
+		if err != nil {
+			return fmt.Errorf("decoding key %q: %w", kv.Key, err)
+		}
+		encodedKey := kv.Key
+		var values []V
+		for ; ok && kv.Key == encodedKey; kv, ok = next() {
+			value, err := j.Values.Decode(kv.Value)
+			if err != nil {
+				return fmt.Errorf("key %q: decoding value %q: %w", encodedKey, kv.Value, err)
+			}
+			values = append(values, value)
+		}
+		result, err := j.Results.Encode(j.Reduce(key, values))
+		if err != nil {
+			return fmt.Errorf("key %q: encoding result: %w", encodedKey, err)
+		}
+		if err := emit(KeyValue{Key: encodedKey, Value: result}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringJob returns the Job[string, string, string] that runs app's map,
+// combine and reduce functions in the task of tc. It picks the functions
+// in the order App documents.
+func stringJob(tc *TaskContext, app App) Job[string, string, string] {
+	j := Job[string, string, string]{
+		Combine: app.Combine,
+		Keys:    StringSerializer{},
+		Values:  StringSerializer{},
+		Results: StringSerializer{},
+	}
+	switch {
+	case app.MapContext != nil:
+		j.Map = func(record Record) []KeyValue { return app.MapContext(tc, record) }
+	case app.RecordMap != nil:
+		j.Map = app.RecordMap
+	default:
+		j.Map = func(record Record) []KeyValue { return app.Map(record.File, record.Value) }
+	}
+	if app.ReduceContext != nil {
+		j.Reduce = func(key string, values []string) string { return app.ReduceContext(tc, key, values) }
+	} else {
+		j.Reduce = app.Reduce
+	}
+	return j
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// runJob runs app over input in a job directory of its own under dir and
+// returns its counters and output files' contents
+func runJob(t *testing.T, dir, name string, app App, input string) (Counters, []string) {
+	t.Helper()
+	mr := NewMapReduce(nil, nil, 2, []string{input}, WithApp(app), WithJobID(name), WithJobDir(filepath.Join(dir, name)))
+	if err := mr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var outputs []string
+	for _, file := range mr.OutputFiles() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, string(data))
+	}
+	return mr.Counters(), outputs
+}
+
+func TestTypedJobMatchesStringApp(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(input, []byte("the cat and the hat\nthe end\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stringCounters, stringOutput := runJob(t, dir, "string", App{Map: WordCountMap, Reduce: WordCountReduce, Combine: WordCountReduce}, input)
+	typedCounters, typedOutput := runJob(t, dir, "typed", WordCountJob.App(), input)
+	if !reflect.DeepEqual(typedOutput, stringOutput) {
+		t.Errorf("typed output %q differs from string output %q", typedOutput, stringOutput)
+	}
+	for _, name := range []string{MapInputRecords, MapOutputRecords, CombineInputRecords, CombineOutputRecords, ReduceInputRecords, ReduceOutputRecords} {
+		if typedCounters[name] != stringCounters[name] {
+			t.Errorf("%s: typed job counts %d, string app %d", name, typedCounters[name], stringCounters[name])
+		}
+	}
+	if got := stringCounters[CombineInputRecords]; got != 7 {
+		t.Errorf("combiner read %d records; want 7", got)
+	}
+}
@@ -6,18 +6,24 @@ import (
 	"strings"
 )
 
+// wordRegex matches a word: a sequence of letters
+var wordRegex = regexp.MustCompile(`[a-zA-Z]+`)
+
+// splitWords returns the words of contents in lower case
+func splitWords(contents string) []string {
+	words := wordRegex.FindAllString(contents, -1)
+	for i, word := range words {
+		// Convert to lowercase for case-insensitive counting
+		words[i] = strings.ToLower(word)
+	}
+	return words
+}
+
 // WordCountMap is the map function for word counting
 // It takes a filename and file contents, and emits (word, "1") for each word
 func WordCountMap(filename string, contents string) []KeyValue {
-	// Split contents into words using regex
-	// This regex finds sequences of letters
-	wordRegex := regexp.MustCompile(`[a-zA-Z]+`)
-	words := wordRegex.FindAllString(contents, -1)
-
 	var keyValues []KeyValue
-	for _, word := range words {
-		// Convert to lowercase for case-insensitive counting
-		word = strings.ToLower(word)
+	for _, word := range splitWords(contents) {
 		// Emit (word, "1") - each occurrence counts as 1
 		keyValues = append(keyValues, KeyValue{Key: word, Value: "1"})
 	}
@@ -42,3 +48,51 @@ func WordCountReduce(key string, values []string) string {
 
 	return strconv.Itoa(total)
 }
+
+// WordCountStreamReduce is WordCountReduce for the streaming reduce API
+// It adds up the counts one at a time instead of receiving them as a slice
+func WordCountStreamReduce(key string, values *ValueIterator) string {
+	total := 0
+
+	for value, ok := values.Next(); ok; value, ok = values.Next() {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			// If we can't parse the number, assume it's 1
+			count = 1
+		}
+		total += count
+	}
+
+	return strconv.Itoa(total)
+}
+
+// WordCountJob counts words with typed counts: the map function emits
+// (word, 1) and the reduce function adds up ints, so counts are never
+// parsed from strings by hand, and one that fails to decode fails the
+// task rather than being taken as 1
+var WordCountJob = Job[string, int, int]{
+	Map:     WordCountTypedMap,
+	Reduce:  sumCounts,
+	Combine: sumCounts,
+	Keys:    StringSerializer{},
+	Values:  IntSerializer[int]{},
+	Results: IntSerializer[int]{},
+}
+
+// WordCountTypedMap emits (word, 1) for each word of a record
+func WordCountTypedMap(record Record) []Pair[string, int] {
+	var pairs []Pair[string, int]
+	for _, word := range splitWords(record.Value) {
+		pairs = append(pairs, Pair[string, int]{Key: word, Value: 1})
+	}
+	return pairs
+}
+
+// sumCounts adds up a word's counts
+func sumCounts(word string, counts []int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
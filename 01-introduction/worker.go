@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// workerID returns a name identifying this worker process to the coordinator
+func workerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Worker repeatedly asks the coordinator at addr for tasks and runs them
+// with the given application. It returns once the coordinator
+// says the job is finished or can no longer be reached.
+// If shuffleAddr is not empty, the worker serves the output of its map
+// tasks over HTTP on that address, and removes it on returning, so that
+// workers need not share a filesystem for intermediate files.
+func Worker(addr string, app App, shuffleAddr string) error {
+	if err := checkApp(app); err != nil {
+		return err
+	}
+	id := workerID()
+
+	var shuffle *shuffleServer
+	if shuffleAddr != "" {
+		var err error
+		if shuffle, err = startShuffleServer(shuffleAddr); err != nil {
+			return err
+		}
+		defer shuffle.Close()
+		fmt.Printf("Worker %s serving map output on %s\n", id, shuffle.addr)
+	}
+
+	for {
+		var reply RequestTaskReply
+		if err := call(addr, "Coordinator.RequestTask", &RequestTaskArgs{WorkerID: id}, &reply); err != nil {
+			// The coordinator exits once the job is done
+			fmt.Printf("Coordinator unreachable, worker %s exiting: %v\n", id, err)
+			return nil
+		}
+
+		task := reply.Task
+		// Another copy of the task may be running elsewhere; only publish
+		// the output if the coordinator picks this one
+		ctx := withCommitCheck(context.Background(), func() error {
+			args := CommitTaskArgs{WorkerID: id, Type: task.Type, ID: task.ID, Attempt: task.Attempt}
+			var reply CommitTaskReply
+			if err := call(addr, "Coordinator.CommitTask", &args, &reply); err != nil {
+				return fmt.Errorf("asking to commit: %w", err)
+			}
+			if !reply.OK {
+				return errCommitDenied
+			}
+			return nil
+		})
+		var counters Counters
+		var err error
+		switch task.Type {
+		case MapTask:
+			fmt.Printf("Running map task %d: %s\n", task.ID, task.Split)
+			counters, err = doMap(ctx, app, task)
+		case ReduceTask:
+			fmt.Printf("Running reduce task %d\n", task.ID)
+			counters, err = doReduce(ctx, app, task)
+		case WaitTask:
+			time.Sleep(time.Second)
+			continue
+		case ExitTask:
+			fmt.Printf("Job complete, worker %s exiting\n", id)
+			return nil
+		default:
+			return fmt.Errorf("unknown task type %v", task.Type)
+		}
+
+		report := ReportTaskArgs{WorkerID: id, Type: task.Type, ID: task.ID, Attempt: task.Attempt, Counters: counters}
+		var fetchErr *FetchError
+		switch {
+		case errors.As(err, &fetchErr):
+			report.LostAddr = fetchErr.Addr
+			fallthrough
+		case err != nil:
+			report.Err = err.Error()
+		case task.Type == MapTask && shuffle != nil:
+			shuffle.add(task)
+			report.ShuffleAddr = shuffle.addr
+		}
+		if err := call(addr, "Coordinator.ReportTask", &report, &ReportTaskReply{}); err != nil {
+			fmt.Printf("Coordinator unreachable, worker %s exiting: %v\n", id, err)
+			return nil
+		}
+	}
+}